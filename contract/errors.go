@@ -0,0 +1,144 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package contract
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPoolExhausted 连接池耗尽，在waitTimeout内没有拿到可用的socket
+	ErrPoolExhausted = errors.New("netsvr: task socket pool exhausted")
+	// ErrPoolClosed 连接池已经关闭
+	ErrPoolClosed = errors.New("netsvr: task socket pool closed")
+	// ErrGatewayDisconnected 与网关的连接无法建立或已经断开
+	ErrGatewayDisconnected = errors.New("netsvr: gateway disconnected")
+	// ErrGatewayTimeout 与网关的读写超时
+	ErrGatewayTimeout = errors.New("netsvr: gateway timeout")
+	// ErrGatewayNotFound 没有配置目标网关
+	ErrGatewayNotFound = errors.New("netsvr: gateway not found")
+	// ErrInvalidUniqId uniqId格式不正确，无法路由到网关
+	ErrInvalidUniqId = errors.New("netsvr: invalid uniqId")
+	// ErrDecode 网关的响应无法解码
+	ErrDecode = errors.New("netsvr: decode response failed")
+	// ErrEncode 请求无法编码
+	ErrEncode = errors.New("netsvr: encode request failed")
+	// ErrFrameTooLarge 数据帧超过了允许的最大长度
+	ErrFrameTooLarge = errors.New("netsvr: frame too large")
+	// ErrInvalidAddr 网关地址无法解析
+	ErrInvalidAddr = errors.New("netsvr: invalid gateway address")
+	// ErrGatewayUnhealthy 网关的健康检查连续失败，在恢复之前不再向其借出socket
+	ErrGatewayUnhealthy = errors.New("netsvr: gateway unhealthy")
+	// ErrCircuitOpen 网关的熔断器处于打开状态，请求被立即拒绝，参见CircuitOpenError
+	ErrCircuitOpen = errors.New("netsvr: circuit breaker open")
+)
+
+// GatewayError 与某个网关交互时发生的错误，Err通常包裹了上面的某个哨兵错误
+type GatewayError struct {
+	// Addr 网关的task服务器监听的地址
+	Addr string
+	Err  error
+}
+
+func (e *GatewayError) Error() string {
+	return "gateway " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *GatewayError) Unwrap() error {
+	return e.Err
+}
+
+// PartialError 部分网关不可用而被跳过，请求只作用于其余可用的网关
+type PartialError struct {
+	// Skipped 被跳过的网关以及跳过的原因
+	Skipped []*GatewayError
+}
+
+func (e *PartialError) Error() string {
+	items := make([]string, 0, len(e.Skipped))
+	for _, v := range e.Skipped {
+		items = append(items, v.Error())
+	}
+	return "skipped gateways: " + strings.Join(items, "; ")
+}
+
+func (e *PartialError) Unwrap() []error {
+	ret := make([]error, 0, len(e.Skipped))
+	for _, v := range e.Skipped {
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// Addrs 被跳过的网关地址
+func (e *PartialError) Addrs() []string {
+	ret := make([]string, 0, len(e.Skipped))
+	for _, v := range e.Skipped {
+		ret = append(ret, v.Addr)
+	}
+	return ret
+}
+
+// UniqIdError 部分uniqId无法路由到网关而被跳过，请求只作用于其余的uniqId
+type UniqIdError struct {
+	// Invalid 格式不正确的uniqId
+	Invalid []string
+	// Unknown 所在网关没有配置在当前进程中的uniqId
+	Unknown []string
+}
+
+func (e *UniqIdError) Error() string {
+	items := make([]string, 0, 2)
+	if len(e.Invalid) > 0 {
+		items = append(items, fmt.Sprintf("%s: %q", ErrInvalidUniqId.Error(), e.Invalid))
+	}
+	if len(e.Unknown) > 0 {
+		items = append(items, fmt.Sprintf("%s: %q", ErrGatewayNotFound.Error(), e.Unknown))
+	}
+	return strings.Join(items, "; ")
+}
+
+// Unwrap 有格式不正确的uniqId时包含ErrInvalidUniqId，有所在网关没有配置的uniqId时包含ErrGatewayNotFound
+func (e *UniqIdError) Unwrap() []error {
+	ret := make([]error, 0, 2)
+	if len(e.Invalid) > 0 {
+		ret = append(ret, ErrInvalidUniqId)
+	}
+	if len(e.Unknown) > 0 {
+		ret = append(ret, ErrGatewayNotFound)
+	}
+	return ret
+}
+
+// CircuitOpenError 网关的熔断器处于打开状态，在RetryAt之前的请求都会被拒绝，之后放行一个试探的请求
+type CircuitOpenError struct {
+	// Addr 网关的task服务器监听的地址
+	Addr string
+	// RetryAt 熔断器允许试探的时间
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: %s, retry at %s", ErrCircuitOpen.Error(), e.Addr, e.RetryAt.Format(time.RFC3339Nano))
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
@@ -0,0 +1,69 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package contract
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGatewayError(t *testing.T) {
+	var err error = &GatewayError{Addr: "127.0.0.1:6061", Err: ErrPoolExhausted}
+	if !errors.Is(err, ErrPoolExhausted) {
+		t.Error("GatewayError应该包裹原始错误")
+	}
+	if err.Error() != "gateway 127.0.0.1:6061: "+ErrPoolExhausted.Error() {
+		t.Error("GatewayError的错误信息不正确", err.Error())
+	}
+}
+
+func TestPartialError(t *testing.T) {
+	var err error = &PartialError{Skipped: []*GatewayError{
+		{Addr: "127.0.0.1:6061", Err: ErrPoolExhausted},
+		{Addr: "127.0.0.2:6061", Err: ErrGatewayDisconnected},
+	}}
+	if !errors.Is(err, ErrPoolExhausted) || !errors.Is(err, ErrGatewayDisconnected) {
+		t.Error("PartialError应该包裹所有网关的错误")
+	}
+	var partialErr *PartialError
+	if !errors.As(err, &partialErr) || len(partialErr.Addrs()) != 2 || partialErr.Addrs()[1] != "127.0.0.2:6061" {
+		t.Error("PartialError的网关地址不正确")
+	}
+}
+
+func TestUniqIdError(t *testing.T) {
+	var err error = &UniqIdError{Invalid: []string{"invalid"}}
+	if !errors.Is(err, ErrInvalidUniqId) || errors.Is(err, ErrGatewayNotFound) {
+		t.Error("UniqIdError应该只包裹ErrInvalidUniqId", err)
+	}
+	err = &UniqIdError{Invalid: []string{"invalid"}, Unknown: []string{"0a00000117ad6553f1000000002a"}}
+	if !errors.Is(err, ErrInvalidUniqId) || !errors.Is(err, ErrGatewayNotFound) {
+		t.Error("UniqIdError应该包裹ErrInvalidUniqId与ErrGatewayNotFound", err)
+	}
+}
+
+func TestCircuitOpenError(t *testing.T) {
+	var err error = &GatewayError{Addr: "127.0.0.1:6061", Err: &CircuitOpenError{Addr: "127.0.0.1:6061", RetryAt: time.Now()}}
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Error("CircuitOpenError应该包裹ErrCircuitOpen")
+	}
+	var circuitErr *CircuitOpenError
+	if !errors.As(err, &circuitErr) || circuitErr.RetryAt.IsZero() {
+		t.Error("CircuitOpenError应该可以通过errors.As取出", err)
+	}
+}
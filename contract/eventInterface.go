@@ -25,3 +25,16 @@ type EventInterface interface {
 	OnMessage(transfer *netsvrProtocol.Transfer)
 	OnClose(connClose *netsvrProtocol.ConnClose)
 }
+
+// GatewayObserverInterface 网关的生命周期观察者，可选实现
+// 通过mainSocket.WithObserver传给mainSocket.Manager，或者由EventInterface的实现者一并实现
+type GatewayObserverInterface interface {
+	// OnGatewayDisconnected 与网关的worker服务器的连接断开，直到重新注册成功前，该网关的事件都会丢失
+	OnGatewayDisconnected(addr string)
+	// OnGatewayReconnected 与网关的worker服务器重新建立了连接，尚未注册
+	OnGatewayReconnected(addr string)
+	// OnGatewayRegistered 注册到网关成功，开始接收该网关的事件
+	OnGatewayRegistered(addr string, connId string)
+	// OnGatewayUnregistered 收到网关取消注册的响应，不再接收该网关的事件
+	OnGatewayUnregistered(addr string)
+}
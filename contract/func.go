@@ -17,31 +17,117 @@
 package contract
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"net"
 	"strconv"
+	"strings"
 )
 
-// AddrConvertToHex 将网关的task服务器监听的ip地址转为16进制字符串
+// Resolver 解析主机名，*net.Resolver实现了该接口
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// nonIPAddrPrefix addr不是ip:port时，AddrConvertToHex的结果的前缀，前缀不是16进制的字符，结果不会与任何uniqId中的网关地址相同
+const nonIPAddrPrefix = "addr:"
+
+// AddrConvertToHex 将网关的task服务器监听的ip地址转为16进制字符串，IPv4是12个字符，IPv6是36个字符
+// addr不是ip:port时，例如主机名、通过socket.WithDialer连接的Unix域套接字、net.Pipe，返回nonIPAddrPrefix加上addr本身的16进制编码
+// 这样的地址可以作为网关的唯一标识，但是无法与uniqId中的网关地址匹配，也不会与ip地址的结果冲突，主机名需要通过ResolveAddrAsHex解析
 func AddrConvertToHex(addr string) string {
-	template := make([]byte, 6)
-	//ip、port预先解析成模板
-	host, portStr, _ := net.SplitHostPort(addr)
-	port, _ := strconv.Atoi(portStr)
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		return nonIPAddrPrefix + hex.EncodeToString([]byte(addr))
+	}
 	ip := net.ParseIP(host)
+	if ip == nil {
+		return nonIPAddrPrefix + hex.EncodeToString([]byte(addr))
+	}
+	return encodeAddr(ip, port)
+}
+
+// ResolveAddrAsHex 将网关的task服务器监听的地址转为16进制字符串，主机名通过resolver解析，resolver为nil时使用net.DefaultResolver
+// 主机名解析出多个ip时优先使用IPv4，地址无法解析时返回的错误包裹了ErrInvalidAddr
+func ResolveAddrAsHex(ctx context.Context, resolver Resolver, addr string) (string, error) {
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return encodeAddr(ip, port), nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrInvalidAddr, addr, err)
+	}
+	var ip net.IP
+	for _, ipAddr := range ipAddrs {
+		if ipAddr.IP.To4() != nil {
+			ip = ipAddr.IP
+			break
+		}
+		if ip == nil {
+			ip = ipAddr.IP
+		}
+	}
+	if ip == nil {
+		return "", fmt.Errorf("%w: %s: no ip address", ErrInvalidAddr, addr)
+	}
+	return encodeAddr(ip, port), nil
+}
+
+// splitAddr 拆分host:port，port必须是0到65535之间的数字
+func splitAddr(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %w", ErrInvalidAddr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %s: invalid port", ErrInvalidAddr, addr)
+	}
+	return host, uint16(port), nil
+}
+
+// encodeAddr 将ip与port编码为16进制字符串，格式是：ip(IPv4是4字节，IPv6是16字节)+port(2字节)
+func encodeAddr(ip net.IP, port uint16) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()
+	}
+	template := make([]byte, len(ip)+2)
 	//网关进程的task服务监听的ip地址
-	binary.BigEndian.PutUint32(template[0:4], binary.BigEndian.Uint32(ip[12:16]))
+	copy(template, ip)
 	//网关进程的task服务监听的port
-	binary.BigEndian.PutUint16(template[4:6], uint16(port))
+	binary.BigEndian.PutUint16(template[len(ip):], port)
 	return hex.EncodeToString(template)
 }
 
-// UniqIdConvertToAddrAsHex 将uniqId转为网关的task服务器监听的ip地址的16进制字符串
+// UniqIdConvertToAddrAsHex 将uniqId转为网关的task服务器监听的ip地址的16进制字符串，uniqId格式不正确时返回空字符串
+// 返回的是小写的16进制字符串，与AddrConvertToHex的结果一致
+// 需要uniqId中的其它信息时，使用ParseUniqId
 func UniqIdConvertToAddrAsHex(uniqId string) string {
-	if len(uniqId) != 28 {
-		//网关分配给连接的唯一id，格式是：网关进程的task服务监听的ip地址(4字节)+网关进程的task服务监听的port(2字节)+时间戳(4字节)+自增id(4字节)，共14字节，28个16进制的字符
+	//格式参见UniqId，末尾的时间戳与自增id共8字节，16个16进制的字符
+	if (len(uniqId) != 28 && len(uniqId) != 52) || !isHex(uniqId) {
 		return ""
 	}
-	return uniqId[0:12]
+	return strings.ToLower(uniqId[0 : len(uniqId)-16])
+}
+
+// isHex 是否全部是16进制的字符
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
 }
@@ -16,10 +16,89 @@
 
 package contract
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
 
 func TestFunc_AddrConvertToHex(t *testing.T) {
 	if AddrConvertToHex("127.0.0.1:6061") != "7f00000117ad" {
 		t.Error("task服务器监听的ip地址转为16进制字符串失败")
 	}
 }
+
+func TestFunc_AddrConvertToHex_NotIP(t *testing.T) {
+	//6字节与18字节的地址，其16进制编码的长度与IPv4、IPv6的结果相同
+	addrs := []string{"/run/netsvr.sock", "pipe", "localhost:6061", "127.0.0.1:abc", "abcdef", "/run/netsvr/g.sock"}
+	seen := make(map[string]string)
+	for _, addr := range addrs {
+		v := AddrConvertToHex(addr)
+		if isHex(v) {
+			t.Errorf("%s should not be routable, got %s", addr, v)
+		}
+		if other, ok := seen[v]; ok {
+			t.Errorf("%s and %s should be distinct", addr, other)
+		}
+		seen[v] = addr
+	}
+}
+
+func TestFunc_AddrConvertToHex_IPv6(t *testing.T) {
+	if v := AddrConvertToHex("[2001:db8::1]:6061"); v != "20010db800000000000000000000000117ad" {
+		t.Error("IPv6地址转为16进制字符串失败", v)
+	}
+	if v := AddrConvertToHex("[::ffff:127.0.0.1]:6061"); v != "7f00000117ad" {
+		t.Error("IPv4-mapped IPv6地址应当按IPv4编码", v)
+	}
+}
+
+// fakeResolver 把主机名解析为固定的ip列表
+type fakeResolver map[string][]net.IPAddr
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := r[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestFunc_ResolveAddrAsHex(t *testing.T) {
+	resolver := fakeResolver{
+		"gateway.local": {{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("127.0.0.1")}},
+		"v6.local":      {{IP: net.ParseIP("2001:db8::1")}},
+		"empty.local":   {},
+	}
+	cases := map[string]string{
+		"127.0.0.1:6061":     "7f00000117ad",
+		"gateway.local:6061": "7f00000117ad",
+		"v6.local:6061":      "20010db800000000000000000000000117ad",
+	}
+	for addr, expected := range cases {
+		v, err := ResolveAddrAsHex(context.Background(), resolver, addr)
+		if err != nil || v != expected {
+			t.Errorf("%s: expected %s, got %s %v", addr, expected, v, err)
+		}
+	}
+	for _, addr := range []string{"gateway.local", "gateway.local:abc", "gateway.local:70000", "unknown.local:6061", "empty.local:6061"} {
+		if _, err := ResolveAddrAsHex(context.Background(), resolver, addr); !errors.Is(err, ErrInvalidAddr) {
+			t.Errorf("%s: expected ErrInvalidAddr, got %v", addr, err)
+		}
+	}
+}
+
+func TestFunc_UniqIdConvertToAddrAsHex(t *testing.T) {
+	if v := UniqIdConvertToAddrAsHex("7f00000117ad" + "0000000100000002"); v != "7f00000117ad" {
+		t.Error("IPv4 uniqId", v)
+	}
+	if v := UniqIdConvertToAddrAsHex("20010db800000000000000000000000117ad" + "0000000100000002"); v != "20010db800000000000000000000000117ad" {
+		t.Error("IPv6 uniqId", v)
+	}
+	if v := UniqIdConvertToAddrAsHex("7F00000117AD" + "0000000100000002"); v != "7f00000117ad" {
+		t.Error("uppercase uniqId", v)
+	}
+	if v := UniqIdConvertToAddrAsHex("bad"); v != "" {
+		t.Error("invalid uniqId", v)
+	}
+}
@@ -0,0 +1,83 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package contract
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// UniqId 网关分配给连接的唯一id，格式是：网关进程的task服务监听的ip地址+port(2字节)+时间戳(4字节)+自增id(4字节)
+// ip地址是IPv4时共14字节，28个16进制的字符，是IPv6时共26字节，52个16进制的字符
+type UniqId struct {
+	// IP 网关进程的task服务监听的ip地址
+	IP net.IP
+	// Port 网关进程的task服务监听的port
+	Port uint16
+	// CreatedAt 连接的创建时间，精确到秒
+	CreatedAt time.Time
+	// Seq 网关进程内的自增id
+	Seq uint32
+}
+
+// ParseUniqId 解析uniqId，格式不正确时返回的错误包裹了ErrInvalidUniqId
+func ParseUniqId(uniqId string) (UniqId, error) {
+	if len(uniqId) != 28 && len(uniqId) != 52 {
+		return UniqId{}, fmt.Errorf("%w: %q: invalid length %d", ErrInvalidUniqId, uniqId, len(uniqId))
+	}
+	data, err := hex.DecodeString(uniqId)
+	if err != nil {
+		return UniqId{}, fmt.Errorf("%w: %q: %w", ErrInvalidUniqId, uniqId, err)
+	}
+	ipLen := len(data) - 10
+	ip := make(net.IP, ipLen)
+	copy(ip, data[:ipLen])
+	return UniqId{
+		IP:        ip,
+		Port:      binary.BigEndian.Uint16(data[ipLen : ipLen+2]),
+		CreatedAt: time.Unix(int64(binary.BigEndian.Uint32(data[ipLen+2:ipLen+6])), 0),
+		Seq:       binary.BigEndian.Uint32(data[ipLen+6:]),
+	}, nil
+}
+
+// String 编码为uniqId
+func (u UniqId) String() string {
+	ip := u.IP.To4()
+	if ip == nil {
+		ip = u.IP.To16()
+	}
+	data := make([]byte, 0, len(ip)+10)
+	data = append(data, ip...)
+	data = binary.BigEndian.AppendUint16(data, u.Port)
+	data = binary.BigEndian.AppendUint32(data, uint32(u.CreatedAt.Unix()))
+	data = binary.BigEndian.AppendUint32(data, u.Seq)
+	return hex.EncodeToString(data)
+}
+
+// Addr 网关的task服务器监听的地址
+func (u UniqId) Addr() string {
+	return net.JoinHostPort(u.IP.String(), strconv.Itoa(int(u.Port)))
+}
+
+// AddrAsHex 网关的task服务器监听的地址的16进制字符串，与AddrConvertToHex的结果一致
+func (u UniqId) AddrAsHex() string {
+	return encodeAddr(u.IP, u.Port)
+}
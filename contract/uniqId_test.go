@@ -0,0 +1,65 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package contract
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUniqId_Parse(t *testing.T) {
+	uniqId, err := ParseUniqId("7f00000117ad" + "6553f100" + "0000002a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uniqId.IP.Equal(net.IPv4(127, 0, 0, 1)) || uniqId.Port != 6061 || uniqId.Seq != 42 {
+		t.Error("unexpected uniqId", uniqId)
+	}
+	if !uniqId.CreatedAt.Equal(time.Unix(0x6553f100, 0)) {
+		t.Error("unexpected CreatedAt", uniqId.CreatedAt)
+	}
+	if uniqId.Addr() != "127.0.0.1:6061" || uniqId.AddrAsHex() != AddrConvertToHex("127.0.0.1:6061") {
+		t.Error("unexpected addr", uniqId.Addr(), uniqId.AddrAsHex())
+	}
+	if uniqId.String() != "7f00000117ad6553f1000000002a" {
+		t.Error("String should encode the uniqId", uniqId.String())
+	}
+}
+
+func TestUniqId_Parse_IPv6(t *testing.T) {
+	raw := "20010db800000000000000000000000117ad" + "6553f100" + "00000001"
+	uniqId, err := ParseUniqId(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uniqId.Addr() != "[2001:db8::1]:6061" || uniqId.String() != raw {
+		t.Error("unexpected uniqId", uniqId.Addr(), uniqId.String())
+	}
+}
+
+func TestUniqId_Parse_Invalid(t *testing.T) {
+	for _, raw := range []string{"", "invalid", "7f00000117ad6553f1000000002", "zz00000117ad6553f1000000002a"} {
+		if _, err := ParseUniqId(raw); !errors.Is(err, ErrInvalidUniqId) {
+			t.Errorf("%q: expected ErrInvalidUniqId, got %v", raw, err)
+		}
+		if UniqIdConvertToAddrAsHex(raw) != "" {
+			t.Errorf("%q: UniqIdConvertToAddrAsHex should return empty string", raw)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+// Package discovery 提供网关地址的发现机制，并把网关的增减同步到mainSocket.Manager与taskSocket.Manger
+package discovery
+
+import (
+	"context"
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"sort"
+	"time"
+)
+
+// defaultInterval 没有设置或者设置了非正数的轮询间隔时，使用的默认值
+const defaultInterval = time.Second * 10
+
+// Gateway 一个网关进程对外提供的地址
+type Gateway struct {
+	// Worker 网关的worker服务器监听的地址，业务进程通过它注册并接收客户端事件，为空表示不连接worker服务器
+	Worker string `json:"worker" yaml:"worker"`
+	// Task 网关的task服务器监听的地址，业务进程通过它向网关发送指令，为空表示不连接task服务器
+	Task string `json:"task" yaml:"task"`
+}
+
+// Discovery 网关发现
+type Discovery interface {
+	// Lookup 返回当前的网关列表
+	Lookup(ctx context.Context) ([]Gateway, error)
+	// Watch 持续监听网关列表，每次拿到完整的网关列表都会调用notify，直到ctx被取消
+	// notify拿到的是全量列表，不保证与上一次不同，调用方需要自己比对差异
+	Watch(ctx context.Context, notify func(gateways []Gateway)) error
+}
+
+// normalize 去重并排序，保证相同的网关集合得到相同的列表
+func normalize(gateways []Gateway) []Gateway {
+	set := make(map[Gateway]struct{}, len(gateways))
+	ret := make([]Gateway, 0, len(gateways))
+	for _, v := range gateways {
+		if v.Worker == "" && v.Task == "" {
+			continue
+		}
+		if _, ok := set[v]; ok {
+			continue
+		}
+		set[v] = struct{}{}
+		ret = append(ret, v)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Worker != ret[j].Worker {
+			return ret[i].Worker < ret[j].Worker
+		}
+		return ret[i].Task < ret[j].Task
+	})
+	return ret
+}
+
+// poll 每隔interval调用一次lookup，成功则通知notify，失败则记录日志并保留上一次的结果，直到ctx被取消
+func poll(ctx context.Context, name string, interval time.Duration, lookup func(ctx context.Context) ([]Gateway, error), notify func(gateways []Gateway)) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if gateways, err := lookup(ctx); err == nil {
+			notify(gateways)
+		} else if ctx.Err() == nil {
+			log.Error("discovery "+name+" lookup failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"github.com/buexplain/netsvr-business-go/v2/mainSocket"
+	"github.com/buexplain/netsvr-business-go/v2/taskSocket"
+	"sync"
+)
+
+// Syncer 将Discovery发现的网关同步到mainSocket.Manager与taskSocket.Manger
+type Syncer struct {
+	discovery         Discovery
+	mainSocketManager *mainSocket.Manager
+	newMainSocket     func(addr string) *mainSocket.MainSocket
+	taskSocketManger  *taskSocket.Manger
+	newPool           func(addr string) *taskSocket.Pool
+	//已经同步到管理器的worker服务器地址、task服务器地址
+	workers map[string]struct{}
+	tasks   map[string]struct{}
+	//因为管理器中已经存在同一个网关而跳过的地址，只在第一次跳过时打印日志
+	skippedWorkers map[string]struct{}
+	skippedTasks   map[string]struct{}
+	mux            sync.Mutex
+}
+
+// NewSyncer newMainSocket、newPool根据网关的地址创建对应的MainSocket、Pool
+// 只需要接收事件的业务进程可以把taskSocketManger传nil，只需要发送指令的业务进程可以把mainSocketManager传nil
+// newPool返回的Pool如果需要心跳，请在newPool内调用Pool.LoopHeartbeat
+func NewSyncer(discovery Discovery, mainSocketManager *mainSocket.Manager, newMainSocket func(addr string) *mainSocket.MainSocket, taskSocketManger *taskSocket.Manger, newPool func(addr string) *taskSocket.Pool) *Syncer {
+	return &Syncer{
+		discovery:         discovery,
+		mainSocketManager: mainSocketManager,
+		newMainSocket:     newMainSocket,
+		taskSocketManger:  taskSocketManger,
+		newPool:           newPool,
+		workers:           make(map[string]struct{}),
+		tasks:             make(map[string]struct{}),
+		skippedWorkers:    make(map[string]struct{}),
+		skippedTasks:      make(map[string]struct{}),
+	}
+}
+
+// Run 持续的把网关的变化同步到管理器，直到ctx被取消
+func (s *Syncer) Run(ctx context.Context) error {
+	return s.discovery.Watch(ctx, s.Sync)
+}
+
+// Sync 添加新出现的网关，移除已经消失的网关
+// 添加失败的网关不会被记录，创建的MainSocket、Pool会被关闭，下一次Sync时会重试
+// 管理器中已经存在同一个网关的地址，例如通过AddSocket添加的，或者主机名与ip解析到同一个地址，不会被添加，也不会被移除
+func (s *Syncer) Sync(gateways []Gateway) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	workers := make(map[string]struct{}, len(gateways))
+	tasks := make(map[string]struct{}, len(gateways))
+	for _, v := range gateways {
+		if v.Worker != "" {
+			workers[v.Worker] = struct{}{}
+		}
+		if v.Task != "" {
+			tasks[v.Task] = struct{}{}
+		}
+	}
+	if s.mainSocketManager != nil {
+		reconcile(s.workers, s.skippedWorkers, workers, func(addr string) bool {
+			return s.mainSocketManager.HasGateway(s.mainSocketManager.AddrAsHex(addr))
+		}, func(addr string) bool {
+			socket := s.newMainSocket(addr)
+			if s.mainSocketManager.AddGateway(socket) {
+				return true
+			}
+			socket.Close()
+			return false
+		}, s.mainSocketManager.RemoveGateway)
+	}
+	if s.taskSocketManger != nil {
+		reconcile(s.tasks, s.skippedTasks, tasks, func(addr string) bool {
+			return s.taskSocketManger.HasGateway(s.taskSocketManger.AddrAsHex(addr))
+		}, func(addr string) bool {
+			pool := s.newPool(addr)
+			if s.taskSocketManger.AddGateway(pool) {
+				return true
+			}
+			pool.Close()
+			return false
+		}, s.taskSocketManger.RemoveGateway)
+	}
+}
+
+// reconcile 比对current与target的差异，调用add、remove，并把current更新为同步后的结果
+// has返回true的地址已经由其它途径添加到管理器，记入skipped，不调用add
+func reconcile(current map[string]struct{}, skipped map[string]struct{}, target map[string]struct{}, has func(addr string) bool, add func(addr string) bool, remove func(addr string) bool) {
+	for addr := range current {
+		if _, ok := target[addr]; !ok {
+			remove(addr)
+			delete(current, addr)
+			log.Info("discovery remove gateway " + addr)
+		}
+	}
+	for addr := range skipped {
+		if _, ok := target[addr]; !ok {
+			delete(skipped, addr)
+		}
+	}
+	for addr := range target {
+		if _, ok := current[addr]; ok {
+			continue
+		}
+		if has(addr) {
+			if _, ok := skipped[addr]; !ok {
+				skipped[addr] = struct{}{}
+				log.Info("discovery skip gateway " + addr + ", already registered")
+			}
+			continue
+		}
+		delete(skipped, addr)
+		if add(addr) {
+			current[addr] = struct{}{}
+			log.Info("discovery add gateway " + addr)
+		} else {
+			log.Error("discovery add gateway " + addr + " failed")
+		}
+	}
+}
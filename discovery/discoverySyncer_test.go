@@ -0,0 +1,82 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"github.com/buexplain/netsvr-business-go/v2/taskSocket"
+	"testing"
+	"time"
+)
+
+func TestSyncer_Sync(t *testing.T) {
+	addr1 := testHelper.ListenSilent(t).Addr().String()
+	addr2 := testHelper.ListenSilent(t).Addr().String()
+	manger := taskSocket.NewManger()
+	defer manger.Close()
+	newPool := func(addr string) *taskSocket.Pool {
+		factory := taskSocket.NewFactory(addr, time.Second, time.Second, time.Second)
+		return taskSocket.NewPool(1, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"))
+	}
+	syncer := NewSyncer(NewStatic(), nil, nil, manger, newPool)
+	syncer.Sync([]Gateway{{Task: addr1}, {Task: addr2}})
+	if manger.Count() != 2 {
+		t.Fatal("expected 2 gateways, got", manger.Count())
+	}
+	syncer.Sync([]Gateway{{Task: addr2}})
+	if manger.Count() != 1 {
+		t.Fatal("expected 1 gateway, got", manger.Count())
+	}
+	if socket, err := manger.GetSocketContext(context.Background(), contract.AddrConvertToHex(addr2)); err != nil {
+		t.Error(err)
+	} else {
+		socket.Release()
+	}
+	syncer.Sync(nil)
+	if manger.Count() != 0 {
+		t.Fatal("expected 0 gateway, got", manger.Count())
+	}
+}
+
+func TestSyncer_Sync_AlreadyRegistered(t *testing.T) {
+	addr := testHelper.ListenSilent(t).Addr().String()
+	manger := taskSocket.NewManger()
+	defer manger.Close()
+	created := 0
+	newPool := func(addr string) *taskSocket.Pool {
+		created++
+		factory := taskSocket.NewFactory(addr, time.Second, time.Second, time.Second)
+		return taskSocket.NewPool(1, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"))
+	}
+	manger.AddSocket(newPool(addr))
+	created = 0
+	syncer := NewSyncer(NewStatic(), nil, nil, manger, newPool)
+	//已经存在的网关不会重复创建Pool，每次Sync都不会
+	for i := 0; i < 3; i++ {
+		syncer.Sync([]Gateway{{Task: addr}})
+	}
+	if created != 0 || manger.Count() != 1 {
+		t.Fatal("already registered gateway should be skipped", created, manger.Count())
+	}
+	//不是由Syncer添加的网关，消失时也不会被移除
+	syncer.Sync(nil)
+	if manger.Count() != 1 {
+		t.Fatal("gateway added by others should not be removed", manger.Count())
+	}
+}
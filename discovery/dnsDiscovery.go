@@ -0,0 +1,128 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Resolver dns解析器，*net.Resolver实现了该接口，测试时可以替换成本地的实现
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNS 通过dns记录发现网关，并周期性的重新查询
+type DNS struct {
+	resolver Resolver
+	interval time.Duration
+	lookup   func(ctx context.Context) ([]Gateway, error)
+}
+
+// NewDNSA 通过A记录发现网关，host解析出的每个ip都是一个网关，网关的worker服务器与task服务器分别监听workerPort、taskPort
+// resolver为nil时使用net.DefaultResolver，interval小于等于0时使用默认的10秒
+func NewDNSA(resolver Resolver, host string, workerPort int, taskPort int, interval time.Duration) *DNS {
+	d := newDNS(resolver, interval)
+	d.lookup = func(ctx context.Context) ([]Gateway, error) {
+		ips, err := d.resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		gateways := make([]Gateway, 0, len(ips))
+		for _, ip := range ips {
+			gateways = append(gateways, Gateway{
+				Worker: net.JoinHostPort(ip, strconv.Itoa(workerPort)),
+				Task:   net.JoinHostPort(ip, strconv.Itoa(taskPort)),
+			})
+		}
+		return normalize(gateways), nil
+	}
+	return d
+}
+
+// NewDNSSRV 通过SRV记录发现网关，workerName、taskName分别是worker服务器、task服务器的SRV记录名，例如：_worker._tcp.netsvr.local
+// SRV记录的目标主机会被解析成ip，同一个ip上的worker服务器与task服务器被视为同一个网关
+// resolver为nil时使用net.DefaultResolver，interval小于等于0时使用默认的10秒
+func NewDNSSRV(resolver Resolver, workerName string, taskName string, interval time.Duration) *DNS {
+	d := newDNS(resolver, interval)
+	d.lookup = func(ctx context.Context) ([]Gateway, error) {
+		workers, err := d.lookupSRV(ctx, workerName)
+		if err != nil {
+			return nil, err
+		}
+		tasks, err := d.lookupSRV(ctx, taskName)
+		if err != nil {
+			return nil, err
+		}
+		gateways := make([]Gateway, 0, len(tasks))
+		for ip, task := range tasks {
+			gateways = append(gateways, Gateway{Worker: workers[ip], Task: task})
+		}
+		for ip, worker := range workers {
+			if _, ok := tasks[ip]; !ok {
+				gateways = append(gateways, Gateway{Worker: worker})
+			}
+		}
+		return normalize(gateways), nil
+	}
+	return d
+}
+
+func newDNS(resolver Resolver, interval time.Duration) *DNS {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	return &DNS{
+		resolver: resolver,
+		interval: interval,
+	}
+}
+
+// lookupSRV 查询SRV记录，返回ip到ip:port的映射
+func (d *DNS) lookupSRV(ctx context.Context, name string) (map[string]string, error) {
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(records))
+	for _, record := range records {
+		ips, err := d.resolver.LookupHost(ctx, record.Target)
+		if err != nil {
+			return nil, fmt.Errorf("lookup %s: %w", record.Target, err)
+		}
+		for _, ip := range ips {
+			ret[ip] = net.JoinHostPort(ip, strconv.Itoa(int(record.Port)))
+		}
+	}
+	return ret, nil
+}
+
+func (d *DNS) Lookup(ctx context.Context) ([]Gateway, error) {
+	return d.lookup(ctx)
+}
+
+// Watch 每隔interval重新查询，查询失败时保留上一次的结果
+func (d *DNS) Watch(ctx context.Context, notify func(gateways []Gateway)) error {
+	return poll(ctx, "dns", d.interval, d.lookup, notify)
+}
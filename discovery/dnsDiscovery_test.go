@@ -0,0 +1,136 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver 本地的dns解析器
+type fakeResolver struct {
+	mux   sync.Mutex
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if ips, ok := r.hosts[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if records, ok := r.srv[name]; ok {
+		return name, records, nil
+	}
+	return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) setHost(host string, ips ...string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.hosts[host] = ips
+}
+
+func TestDNS_A(t *testing.T) {
+	resolver := &fakeResolver{hosts: map[string][]string{"netsvr.local": {"10.0.0.2", "10.0.0.1"}}}
+	d := NewDNSA(resolver, "netsvr.local", 6061, 6062, time.Millisecond*10)
+	gateways, err := d.Lookup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Gateway{
+		{Worker: "10.0.0.1:6061", Task: "10.0.0.1:6062"},
+		{Worker: "10.0.0.2:6061", Task: "10.0.0.2:6062"},
+	}
+	if !reflect.DeepEqual(gateways, expected) {
+		t.Error(gateways)
+	}
+	//解析记录变化后，Watch会通知新的网关列表
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notified := make(chan []Gateway, 16)
+	go func() {
+		_ = d.Watch(ctx, func(gateways []Gateway) {
+			notified <- gateways
+		})
+	}()
+	<-notified
+	resolver.setHost("netsvr.local", "10.0.0.3")
+	for gateways := range notified {
+		if len(gateways) == 1 && gateways[0].Task == "10.0.0.3:6062" {
+			break
+		}
+	}
+	if _, err := NewDNSA(resolver, "unknown.local", 6061, 6062, time.Second).Lookup(context.Background()); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDNS_SRV(t *testing.T) {
+	resolver := &fakeResolver{
+		hosts: map[string][]string{
+			"gw1.netsvr.local": {"10.0.0.1"},
+			"gw2.netsvr.local": {"10.0.0.2"},
+		},
+		srv: map[string][]*net.SRV{
+			"_worker._tcp.netsvr.local": {
+				{Target: "gw1.netsvr.local", Port: 6061},
+				{Target: "gw2.netsvr.local", Port: 7061},
+			},
+			"_task._tcp.netsvr.local": {
+				{Target: "gw1.netsvr.local", Port: 6062},
+			},
+		},
+	}
+	gateways, err := NewDNSSRV(resolver, "_worker._tcp.netsvr.local", "_task._tcp.netsvr.local", time.Second).Lookup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Gateway{
+		{Worker: "10.0.0.1:6061", Task: "10.0.0.1:6062"},
+		{Worker: "10.0.0.2:7061"},
+	}
+	if !reflect.DeepEqual(gateways, expected) {
+		t.Error(gateways)
+	}
+	_, err = NewDNSSRV(resolver, "_worker._tcp.netsvr.local", "_none._tcp.netsvr.local", time.Second).Lookup(context.Background())
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		t.Error(err)
+	}
+}
+
+func TestDNS_DefaultInterval(t *testing.T) {
+	if d := NewDNSA(nil, "netsvr.local", 6061, 6062, 0); d.interval != defaultInterval {
+		t.Error("NewDNSA should apply the default interval", d.interval)
+	}
+	if d := NewDNSSRV(nil, "_worker._tcp.netsvr.local", "_task._tcp.netsvr.local", -time.Second); d.interval != defaultInterval {
+		t.Error("NewDNSSRV should apply the default interval", d.interval)
+	}
+}
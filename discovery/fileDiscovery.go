@@ -0,0 +1,70 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File 从本地的json或yaml文件读取网关列表，并周期性的重新读取
+// 文件内容是网关的数组，例如：[{"worker": "127.0.0.1:6061", "task": "127.0.0.1:6062"}]
+// 文件格式由扩展名决定，.yaml、.yml按yaml解析，其余按json解析
+type File struct {
+	path     string
+	interval time.Duration
+}
+
+// NewFile interval是重新读取文件的间隔，小于等于0时使用默认的10秒
+func NewFile(path string, interval time.Duration) *File {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	return &File{
+		path:     path,
+		interval: interval,
+	}
+}
+
+func (f *File) Lookup(_ context.Context) ([]Gateway, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var gateways []Gateway
+	switch strings.ToLower(filepath.Ext(f.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &gateways)
+	default:
+		err = json.Unmarshal(data, &gateways)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", f.path, err)
+	}
+	return normalize(gateways), nil
+}
+
+// Watch 每隔interval重新读取文件，文件不存在或解析失败时保留上一次的结果
+func (f *File) Watch(ctx context.Context, notify func(gateways []Gateway)) error {
+	return poll(ctx, "file "+f.path, f.interval, f.Lookup, notify)
+}
@@ -0,0 +1,112 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFile_Lookup(t *testing.T) {
+	dir := t.TempDir()
+	expected := []Gateway{
+		{Worker: "127.0.0.1:6061", Task: "127.0.0.1:6062"},
+		{Worker: "127.0.0.2:6061", Task: "127.0.0.2:6062"},
+	}
+	files := map[string]string{
+		"gateways.json": `[{"worker": "127.0.0.2:6061", "task": "127.0.0.2:6062"}, {"worker": "127.0.0.1:6061", "task": "127.0.0.1:6062"}]`,
+		"gateways.yaml": "- worker: 127.0.0.1:6061\n  task: 127.0.0.1:6062\n- worker: 127.0.0.2:6061\n  task: 127.0.0.2:6062\n- worker: 127.0.0.1:6061\n  task: 127.0.0.1:6062\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		gateways, err := NewFile(path, time.Second).Lookup(context.Background())
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !reflect.DeepEqual(gateways, expected) {
+			t.Error(name, gateways)
+		}
+	}
+}
+
+func TestFile_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateways.json")
+	if err := os.WriteFile(path, []byte(`[{"task": "127.0.0.1:6062"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	notified := make(chan []Gateway, 16)
+	done := make(chan error)
+	go func() {
+		done <- NewFile(path, time.Millisecond*10).Watch(ctx, func(gateways []Gateway) {
+			notified <- gateways
+		})
+	}()
+	if gateways := <-notified; len(gateways) != 1 || gateways[0].Task != "127.0.0.1:6062" {
+		t.Error(gateways)
+	}
+	//解析失败时不通知，保留上一次的结果
+	if err := os.WriteFile(path, []byte(`[{`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	for len(notified) > 0 {
+		<-notified
+	}
+	if err := os.WriteFile(path, []byte(`[{"task": "127.0.0.2:6062"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for gateways := range notified {
+		if len(gateways) != 1 {
+			t.Fatal(gateways)
+		}
+		if gateways[0].Task == "127.0.0.2:6062" {
+			break
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Error(err)
+	}
+}
+
+func TestFile_Watch_DefaultInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateways.json")
+	if err := os.WriteFile(path, []byte(`[{"task": "127.0.0.1:6062"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := NewFile(path, 0)
+	if f.interval != defaultInterval {
+		t.Error("NewFile should apply the default interval", f.interval)
+	}
+	//零值的interval不能让Watch panic
+	ctx, cancel := context.WithCancel(context.Background())
+	err := f.Watch(ctx, func(gateways []Gateway) {
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Error("Watch should return context.Canceled", err)
+	}
+}
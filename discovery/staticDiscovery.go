@@ -0,0 +1,44 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+)
+
+// Static 固定的网关列表
+type Static struct {
+	gateways []Gateway
+}
+
+func NewStatic(gateways ...Gateway) *Static {
+	return &Static{gateways: normalize(gateways)}
+}
+
+func (s *Static) Lookup(_ context.Context) ([]Gateway, error) {
+	ret := make([]Gateway, len(s.gateways))
+	copy(ret, s.gateways)
+	return ret, nil
+}
+
+// Watch 立即通知一次网关列表，然后阻塞直到ctx被取消
+func (s *Static) Watch(ctx context.Context, notify func(gateways []Gateway)) error {
+	gateways, _ := s.Lookup(ctx)
+	notify(gateways)
+	<-ctx.Done()
+	return ctx.Err()
+}
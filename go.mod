@@ -5,4 +5,5 @@ go 1.23
 require (
 	github.com/buexplain/netsvr-protocol-go/v6 v6.0.1
 	google.golang.org/protobuf v1.36.11
+	gopkg.in/yaml.v3 v3.0.1
 )
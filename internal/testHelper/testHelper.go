@@ -0,0 +1,145 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+// Package testHelper 各个包的测试共用的夹具，只被测试代码引用
+package testHelper
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/buexplain/netsvr-protocol-go/v6/netsvrProtocol"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// RequireGateway addr无法连接时跳过测试，依赖真实网关的测试在没有网关的环境中被跳过，不影响其它测试
+func RequireGateway(t testing.TB, addr string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Millisecond*200)
+	if err != nil {
+		t.Skip("gateway " + addr + " is not reachable: " + err.Error())
+	}
+	_ = conn.Close()
+}
+
+// Listen 监听一个本地端口，每个连接在单独的协程中交给handle处理，测试结束时关闭监听
+func Listen(t testing.TB, handle func(conn net.Conn)) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Serve(t, ln, handle)
+	return ln
+}
+
+// Serve 在ln上接受连接，每个连接在单独的协程中交给handle处理，测试结束时关闭ln
+func Serve(t testing.TB, ln net.Listener, handle func(conn net.Conn)) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+}
+
+// ListenSilent 监听一个本地端口，接受连接后丢弃收到的数据，不做任何响应
+func ListenSilent(t testing.TB) net.Listener {
+	t.Helper()
+	return Listen(t, Discard)
+}
+
+// DeadAddr 返回一个没有监听的本地地址
+func DeadAddr(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// PipeDialer 返回一个通过net.Pipe模拟连接的拨号函数，可以传给socket.WithDialer，每个连接的服务端在单独的协程中交给handle处理
+func PipeDialer(handle func(conn net.Conn)) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(_ context.Context, _ string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go handle(server)
+		return client, nil
+	}
+}
+
+// Discard 丢弃收到的数据，直到连接断开
+func Discard(conn net.Conn) {
+	defer conn.Close()
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// Echo 原样回写收到的数据帧，直到连接断开
+func Echo(conn net.Conn) {
+	defer conn.Close()
+	for {
+		body, err := ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		if err = WriteFrame(conn, body); err != nil {
+			return
+		}
+	}
+}
+
+// ReadFrame 读取一个数据帧，返回不含长度头的负载
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// WriteFrame 给payload加上长度头后写入
+func WriteFrame(w io.Writer, payload []byte) error {
+	data := binary.BigEndian.AppendUint32(make([]byte, 0, len(payload)+4), uint32(len(payload)))
+	_, err := w.Write(append(data, payload...))
+	return err
+}
+
+// WriteCmd 按网关的协议写入cmd与message，message为nil时只写入cmd
+func WriteCmd(w io.Writer, cmd netsvrProtocol.Cmd, message proto.Message) error {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(cmd))
+	if message != nil {
+		var err error
+		if payload, err = (proto.MarshalOptions{}).MarshalAppend(payload, message); err != nil {
+			return err
+		}
+	}
+	return WriteFrame(w, payload)
+}
@@ -17,6 +17,7 @@
 package mainSocket
 
 import (
+	"context"
 	"encoding/binary"
 	"github.com/buexplain/netsvr-business-go/v2/contract"
 	"github.com/buexplain/netsvr-business-go/v2/log"
@@ -25,6 +26,7 @@ import (
 	"google.golang.org/protobuf/proto"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,10 +38,27 @@ type MainSocket struct {
 	connId            string
 	heartbeatInterval time.Duration
 	closedCh          chan struct{}
-	wg                sync.WaitGroup
+	//是否已经关闭，关闭后不再重连
+	closed atomic.Bool
+	//关闭时close，用于打断重连的等待
+	done    chan struct{}
+	wg      sync.WaitGroup
+	backoff Backoff
+	//事件的调度器
+	dispatcher  Dispatcher
+	dispatchKey DispatchKey
+	//重连的尝试次数、成功次数
+	reconnectAttempts  atomic.Uint64
+	reconnectSuccesses atomic.Uint64
+	//网关的生命周期观察者，可能为nil
+	observer contract.GatewayObserverInterface
+	//保护connId与事件的统计，Register与接收事件的协程写入，Stats读取
+	statsMux    sync.Mutex
+	eventCounts map[netsvrProtocol.Cmd]uint64
+	lastEventAt time.Time
 }
 
-func New(eventHandler contract.EventInterface, socket *socket.Socket, heartbeatMessage []byte, events netsvrProtocol.Event, heartbeatInterval time.Duration) *MainSocket {
+func New(eventHandler contract.EventInterface, socket *socket.Socket, heartbeatMessage []byte, events netsvrProtocol.Event, heartbeatInterval time.Duration, opts ...Option) *MainSocket {
 	tmp := &MainSocket{
 		eventHandler:      eventHandler,
 		socket:            socket,
@@ -47,9 +66,19 @@ func New(eventHandler contract.EventInterface, socket *socket.Socket, heartbeatM
 		events:            events,
 		heartbeatInterval: heartbeatInterval,
 		closedCh:          make(chan struct{}, 1),
+		done:              make(chan struct{}),
 		wg:                sync.WaitGroup{},
+		backoff:           DefaultBackoff(),
+		dispatcher:        goroutineDispatcher{},
+		eventCounts:       make(map[netsvrProtocol.Cmd]uint64),
 	}
 	copy(tmp.heartbeatMessage, heartbeatMessage)
+	if observer, ok := eventHandler.(contract.GatewayObserverInterface); ok {
+		tmp.observer = observer
+	}
+	for _, opt := range opts {
+		opt(tmp)
+	}
 	return tmp
 }
 
@@ -93,19 +122,31 @@ func (r *MainSocket) LoopReceive() {
 				log.Info("mainSocket loopReceive " + r.GetAddr() + " quit")
 			}
 		}()
+		//复用同一个数据帧接收数据，processEvent在当前协程内完成解码，proto.Unmarshal会拷贝数据
+		frame := socket.AcquireFrame()
+		defer frame.Release()
 		for {
-			message := r.socket.Receive()
-			if message == nil {
-				//重连
-				if r.socket.Connect() {
-					r.Register()
-				} else {
-					time.Sleep(time.Second * 3)
+			if err := r.socket.ReceiveFrameContext(context.Background(), frame); err != nil {
+				//已经关闭，不再重连
+				if r.closed.Load() {
+					return
+				}
+				r.observe(func(observer contract.GatewayObserverInterface) {
+					observer.OnGatewayDisconnected(r.GetAddr())
+				})
+				//重连失败的次数达到上限，不再重连
+				if r.reconnect() == false {
+					return
 				}
 				continue
 			}
+			message := frame.Payload()
 			cmd := netsvrProtocol.Cmd(binary.BigEndian.Uint32(message[0:4]))
+			r.countEvent(cmd)
 			if cmd == netsvrProtocol.Cmd_Unregister {
+				r.observe(func(observer contract.GatewayObserverInterface) {
+					observer.OnGatewayUnregistered(r.GetAddr())
+				})
 				r.closedCh <- struct{}{}
 				return
 			}
@@ -114,44 +155,140 @@ func (r *MainSocket) LoopReceive() {
 	}()
 }
 
-func (r *MainSocket) processEvent(cmd netsvrProtocol.Cmd, message []byte) {
-	r.wg.Add(1)
-	go func() {
-		defer func() {
-			r.wg.Done()
-			if err := recover(); err != nil {
-				log.Error("processEvent panic", "err", err, "stack", debug.Stack())
+// Start 连接并注册，失败时按Backoff的等待时间重试，直到成功、关闭或失败次数达到MaxAttempts
+func (r *MainSocket) Start() bool {
+	for attempt := 0; ; attempt++ {
+		if r.socket.Connect() {
+			if r.Register() {
+				if r.closed.Load() {
+					r.socket.Close()
+					return false
+				}
+				return true
 			}
-		}()
-		if cmd == netsvrProtocol.Cmd_Transfer {
-			transfer := &netsvrProtocol.Transfer{}
-			err := proto.Unmarshal(message, transfer)
-			if err != nil {
-				return
+			r.socket.Close()
+		}
+		if r.closed.Load() {
+			return false
+		}
+		if r.backoff.MaxAttempts > 0 && attempt+1 >= r.backoff.MaxAttempts {
+			break
+		}
+		t := time.NewTimer(r.backoff.Delay(attempt))
+		select {
+		case <-r.done:
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+	}
+	log.Error("mainSocket start "+r.GetAddr()+" gave up", "attempts", r.backoff.MaxAttempts)
+	return false
+}
+
+// reconnect 按退避策略重连并重新注册，直到成功、关闭或失败次数达到上限
+func (r *MainSocket) reconnect() bool {
+	for attempt := 0; r.backoff.MaxAttempts <= 0 || attempt < r.backoff.MaxAttempts; attempt++ {
+		t := time.NewTimer(r.backoff.Delay(attempt))
+		select {
+		case <-r.done:
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+		r.reconnectAttempts.Add(1)
+		if r.socket.Connect() {
+			r.observe(func(observer contract.GatewayObserverInterface) {
+				observer.OnGatewayReconnected(r.GetAddr())
+			})
+			if r.Register() {
+				if r.closed.Load() {
+					r.socket.Close()
+					return false
+				}
+				r.reconnectSuccesses.Add(1)
+				return true
 			}
+			//注册失败，断开后重新连接，避免在未注册的连接上接收数据
+			r.socket.Close()
+		}
+		if r.closed.Load() {
+			return false
+		}
+	}
+	log.Error("mainSocket reconnect to "+r.GetAddr()+" gave up", "attempts", r.backoff.MaxAttempts)
+	return false
+}
+
+// ReconnectAttempts 重连的尝试次数
+func (r *MainSocket) ReconnectAttempts() uint64 {
+	return r.reconnectAttempts.Load()
+}
+
+// ReconnectSuccesses 重连并重新注册成功的次数
+func (r *MainSocket) ReconnectSuccesses() uint64 {
+	return r.reconnectSuccesses.Load()
+}
+
+// processEvent 解码事件，并交给调度器执行，解码在接收协程内完成，以便调度器拿到事件所属连接的uniqId
+func (r *MainSocket) processEvent(cmd netsvrProtocol.Cmd, message []byte) {
+	var key string
+	var task func()
+	if cmd == netsvrProtocol.Cmd_Transfer {
+		transfer := &netsvrProtocol.Transfer{}
+		err := proto.Unmarshal(message, transfer)
+		if err != nil {
+			return
+		}
+		key = r.key(transfer.UniqId, transfer.CustomerId)
+		task = func() {
 			r.eventHandler.OnMessage(transfer)
+		}
+	} else if cmd == netsvrProtocol.Cmd_ConnClose {
+		connClose := &netsvrProtocol.ConnClose{}
+		err := proto.Unmarshal(message, connClose)
+		if err != nil {
 			return
 		}
-		if cmd == netsvrProtocol.Cmd_ConnClose {
-			connClose := &netsvrProtocol.ConnClose{}
-			err := proto.Unmarshal(message, connClose)
-			if err != nil {
-				return
-			}
+		key = r.key(connClose.UniqId, connClose.CustomerId)
+		task = func() {
 			r.eventHandler.OnClose(connClose)
+		}
+	} else if cmd == netsvrProtocol.Cmd_ConnOpen {
+		connOpen := &netsvrProtocol.ConnOpen{}
+		err := proto.Unmarshal(message, connOpen)
+		if err != nil {
 			return
 		}
-		if cmd == netsvrProtocol.Cmd_ConnOpen {
-			connOpen := &netsvrProtocol.ConnOpen{}
-			err := proto.Unmarshal(message, connOpen)
-			if err != nil {
-				return
-			}
+		key = connOpen.UniqId
+		task = func() {
 			r.eventHandler.OnOpen(connOpen)
-			return
 		}
+	} else {
 		log.Error("unknown cmd", "cmd", cmd)
-	}()
+		return
+	}
+	r.wg.Add(1)
+	ok := r.dispatcher.Dispatch(key, func() {
+		defer func() {
+			r.wg.Done()
+			if err := recover(); err != nil {
+				log.Error("processEvent panic", "err", err, "stack", debug.Stack())
+			}
+		}()
+		task()
+	})
+	if !ok {
+		r.wg.Done()
+	}
+}
+
+// key 按dispatchKey返回事件所属连接的标识
+func (r *MainSocket) key(uniqId string, customerId string) string {
+	if r.dispatchKey == DispatchKeyCustomerId && customerId != "" {
+		return customerId
+	}
+	return uniqId
 }
 
 func (r *MainSocket) Connect() bool {
@@ -186,17 +323,42 @@ func (r *MainSocket) Register() bool {
 		log.Error("register to "+r.GetAddr()+" failed", "code", resp.Code, "message", resp.Message)
 		return false
 	}
+	r.statsMux.Lock()
 	r.connId = resp.ConnId
-	log.Info("register to "+r.GetAddr()+" success", "connId", r.connId)
+	r.statsMux.Unlock()
+	log.Info("register to "+r.GetAddr()+" success", "connId", resp.ConnId)
+	r.observe(func(observer contract.GatewayObserverInterface) {
+		observer.OnGatewayRegistered(r.GetAddr(), resp.ConnId)
+	})
 	return true
 }
 
+// observe 通知观察者，观察者的panic不会影响socket的收发
+func (r *MainSocket) observe(fn func(observer contract.GatewayObserverInterface)) {
+	if r.observer == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("mainSocket observer panic", "err", err, "stack", debug.Stack())
+		}
+	}()
+	fn(r.observer)
+}
+
 func (r *MainSocket) Unregister() bool {
+	return r.UnregisterContext(context.Background())
+}
+
+// UnregisterContext 取消注册，并等待网关的响应，ctx结束时不再等待并返回false，ctx的截止时间与取消同样作用于发送过程
+func (r *MainSocket) UnregisterContext(ctx context.Context) bool {
 	//通知心跳协程，退出心跳机制，避免同时写socket
 	r.closedCh <- struct{}{}
 	<-r.closedCh
 	req := &netsvrProtocol.UnRegisterReq{}
+	r.statsMux.Lock()
 	req.ConnId = r.connId
+	r.statsMux.Unlock()
 	message := make([]byte, 4)
 	binary.BigEndian.PutUint32(message[0:4], uint32(netsvrProtocol.Cmd_Unregister))
 	var err error
@@ -205,16 +367,27 @@ func (r *MainSocket) Unregister() bool {
 		log.Error("marshal netsvrProtocol.UnRegisterReq failed", "error", err)
 		return false
 	}
-	if r.socket.Send(message) {
-		//等待socket收到响应
-		<-r.closedCh
-		log.Info("unregister from "+r.GetAddr()+" success", "connId", r.connId)
+	if err = r.socket.SendContext(ctx, message); err != nil {
+		log.Error("unregister from "+r.GetAddr()+" failed", "error", err)
+		return false
+	}
+	//等待socket收到响应，连接半开或者发送后断开时，响应永远不会到达
+	select {
+	case <-r.closedCh:
+		log.Info("unregister from "+r.GetAddr()+" success", "connId", req.ConnId)
 		return true
+	case <-ctx.Done():
+		log.Error("unregister from "+r.GetAddr()+" failed", "error", ctx.Err())
+		return false
 	}
-	return false
 }
 
+// Close 关闭socket，不再重连，重复调用是安全的
 func (r *MainSocket) Close() {
+	if r.closed.Swap(true) {
+		return
+	}
+	close(r.done)
 	close(r.closedCh)
 	r.wg.Wait()
 	r.socket.Close()
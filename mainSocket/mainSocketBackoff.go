@@ -0,0 +1,77 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package mainSocket
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff 首次连接、注册网关失败以及与网关断开后重连、重新注册的退避策略
+type Backoff struct {
+	// Min 第一次重试前的等待时间，通过WithBackoff设置时，小于等于0则使用DefaultBackoff的值
+	Min time.Duration
+	// Max 等待时间的上限，通过WithBackoff设置时，小于等于0则使用DefaultBackoff的值，但不小于Min
+	Max time.Duration
+	// Factor 每次失败后等待时间的增长倍数，小于1时按1处理，通过WithBackoff设置时，为0则使用DefaultBackoff的值
+	Factor float64
+	// Jitter 抖动比例，取值[0, 1]，实际等待时间在[d*(1-Jitter), d]之间随机，避免多个业务进程同时重连网关
+	Jitter float64
+	// MaxAttempts 连续失败的最大次数，达到后放弃重连，小于等于0表示不限制
+	MaxAttempts int
+}
+
+// DefaultBackoff 默认的退避策略，从1秒开始翻倍增长，最多等待30秒，抖动50%，不限制重试次数
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Min:    time.Second,
+		Max:    time.Second * 30,
+		Factor: 2,
+		Jitter: 0.5,
+	}
+}
+
+// withDefaults 用DefaultBackoff填充没有设置的Min、Max、Factor，避免只设置了部分字段时等待时间为0，重连变成忙等
+func (b Backoff) withDefaults() Backoff {
+	def := DefaultBackoff()
+	if b.Min <= 0 {
+		b.Min = def.Min
+	}
+	if b.Max <= 0 {
+		b.Max = max(def.Max, b.Min)
+	}
+	if b.Factor == 0 {
+		b.Factor = def.Factor
+	}
+	return b
+}
+
+// Delay 第attempt次重试前的等待时间，attempt从0开始
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Min)
+	factor := max(b.Factor, 1)
+	for i := 0; i < attempt && d < float64(b.Max); i++ {
+		d *= factor
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if jitter := min(max(b.Jitter, 0), 1); jitter > 0 && d > 0 {
+		d -= rand.Float64() * d * jitter
+	}
+	return time.Duration(d)
+}
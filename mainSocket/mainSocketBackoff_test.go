@@ -0,0 +1,62 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package mainSocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	b := Backoff{Min: time.Millisecond * 100, Max: time.Second, Factor: 2}
+	expected := []time.Duration{time.Millisecond * 100, time.Millisecond * 200, time.Millisecond * 400, time.Millisecond * 800, time.Second, time.Second}
+	for attempt, v := range expected {
+		if d := b.Delay(attempt); d != v {
+			t.Errorf("attempt %d: expected %s, got %s", attempt, v, d)
+		}
+	}
+	b.Jitter = 0.5
+	for attempt := 0; attempt < 100; attempt++ {
+		d := b.Delay(attempt)
+		upper := expected[min(attempt, len(expected)-1)]
+		if d > upper || d < upper/2 {
+			t.Errorf("attempt %d: %s out of range", attempt, d)
+		}
+	}
+}
+
+func TestWithBackoff_Defaults(t *testing.T) {
+	def := DefaultBackoff()
+	r := &MainSocket{}
+	WithBackoff(Backoff{MaxAttempts: 5})(r)
+	if r.backoff.Min != def.Min || r.backoff.Max != def.Max || r.backoff.Factor != def.Factor || r.backoff.MaxAttempts != 5 {
+		t.Error("WithBackoff should fill Min, Max and Factor", r.backoff)
+	}
+	if r.backoff.Delay(0) <= 0 {
+		t.Error("partly filled Backoff should not retry without waiting")
+	}
+	//Max不小于Min
+	WithBackoff(Backoff{Min: time.Minute})(r)
+	if r.backoff.Max != time.Minute {
+		t.Error("Max should not be less than Min", r.backoff.Max)
+	}
+	//只设置Max时，Min使用默认值
+	WithBackoff(Backoff{Max: time.Second * 10})(r)
+	if r.backoff.Min != def.Min || r.backoff.Max != time.Second*10 {
+		t.Error("WithBackoff should keep the configured Max", r.backoff)
+	}
+}
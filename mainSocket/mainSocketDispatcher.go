@@ -0,0 +1,210 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package mainSocket
+
+import (
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"hash/maphash"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dispatcher 事件的调度器，决定MainSocket收到的事件在哪个协程里执行
+type Dispatcher interface {
+	// Dispatch 提交一个事件，key是事件所属连接的标识，参见WithDispatchKey，返回false表示事件被拒绝，不会执行
+	Dispatch(key string, task func()) bool
+}
+
+// goroutineDispatcher 每个事件一个协程，不限制并发，这是默认的调度方式
+type goroutineDispatcher struct{}
+
+func (goroutineDispatcher) Dispatch(_ string, task func()) bool {
+	go task()
+	return true
+}
+
+// DispatchKey 事件所属连接的标识，有序的调度器按它保证顺序
+type DispatchKey int
+
+const (
+	// DispatchKeyUniqId 按uniqId调度，同一个连接的OnOpen、OnMessage、OnClose依次执行
+	DispatchKeyUniqId DispatchKey = iota
+	// DispatchKeyCustomerId 按customerId调度，同一个客户的多个连接的事件依次执行
+	// OnOpen事件以及没有customerId的事件没有customerId，会退化为按uniqId调度
+	// 注意：同一个连接绑定customerId前后的事件使用不同的key，可能被分到不同的分片，不保证该连接的OnOpen、OnMessage、OnClose的顺序
+	// 需要连接内的顺序时使用DispatchKeyUniqId
+	DispatchKeyCustomerId
+)
+
+// Policy 队列满时的处理策略
+type Policy int
+
+const (
+	// PolicyBackpressure 队列满时暂停从网关接收数据，直到队列有空位，积压会通过tcp传导到网关
+	PolicyBackpressure Policy = iota
+	// PolicyDrop 队列满时直接丢弃事件
+	PolicyDrop
+	// PolicyBlock 队列满时最多等待blockTimeout，超时后丢弃事件
+	PolicyBlock
+)
+
+// DispatcherMetrics 调度器的指标
+type DispatcherMetrics struct {
+	// QueueDepth 队列中等待执行的事件数
+	QueueDepth int
+	// QueueCapacity 队列的容量
+	QueueCapacity int
+	// Processed 已经执行完毕的事件数
+	Processed uint64
+	// Rejected 因为队列满或者已经关闭而被丢弃的事件数
+	Rejected uint64
+}
+
+// WorkerPool 固定数量的协程消费有界队列的事件
+// 多个MainSocket可以共用一个WorkerPool，使用者负责在这些MainSocket都关闭后调用Close
+type WorkerPool struct {
+	//NewWorkerPool只有一个队列，由多个协程消费；NewOrderedWorkerPool每个队列只由一个协程消费
+	queues       []chan func()
+	seed         maphash.Seed
+	policy       Policy
+	blockTimeout time.Duration
+	processed    atomic.Uint64
+	rejected     atomic.Uint64
+	closed       bool
+	mux          sync.RWMutex
+	wg           sync.WaitGroup
+}
+
+// NewWorkerPool workers是协程数，queueSize是队列的容量，blockTimeout只在PolicyBlock策略下生效
+func NewWorkerPool(workers int, queueSize int, policy Policy, blockTimeout time.Duration) *WorkerPool {
+	tmp := newWorkerPool(1, queueSize, policy, blockTimeout)
+	for i := 0; i < max(workers, 1); i++ {
+		tmp.wg.Add(1)
+		go tmp.loop(tmp.queues[0])
+	}
+	return tmp
+}
+
+// NewOrderedWorkerPool 按key把事件分片到shards个串行的协程，key相同的事件按接收的顺序依次执行，key不同的事件并行执行
+// 每个分片的队列容量是queueSize，blockTimeout只在PolicyBlock策略下生效
+func NewOrderedWorkerPool(shards int, queueSize int, policy Policy, blockTimeout time.Duration) *WorkerPool {
+	tmp := newWorkerPool(max(shards, 1), queueSize, policy, blockTimeout)
+	for _, queue := range tmp.queues {
+		tmp.wg.Add(1)
+		go tmp.loop(queue)
+	}
+	return tmp
+}
+
+func newWorkerPool(queues int, queueSize int, policy Policy, blockTimeout time.Duration) *WorkerPool {
+	tmp := &WorkerPool{
+		queues:       make([]chan func(), queues),
+		seed:         maphash.MakeSeed(),
+		policy:       policy,
+		blockTimeout: blockTimeout,
+	}
+	for i := range tmp.queues {
+		tmp.queues[i] = make(chan func(), queueSize)
+	}
+	return tmp
+}
+
+func (p *WorkerPool) loop(queue chan func()) {
+	defer p.wg.Done()
+	for task := range queue {
+		p.run(task)
+	}
+}
+
+func (p *WorkerPool) run(task func()) {
+	defer func() {
+		p.processed.Add(1)
+		if err := recover(); err != nil {
+			log.Error("mainSocket workerPool panic", "err", err, "stack", debug.Stack())
+		}
+	}()
+	task()
+}
+
+func (p *WorkerPool) Dispatch(key string, task func()) bool {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	if p.closed {
+		p.rejected.Add(1)
+		return false
+	}
+	queue := p.queues[0]
+	if len(p.queues) > 1 {
+		queue = p.queues[maphash.String(p.seed, key)%uint64(len(p.queues))]
+	}
+	switch p.policy {
+	case PolicyDrop:
+		select {
+		case queue <- task:
+			return true
+		default:
+		}
+	case PolicyBlock:
+		select {
+		case queue <- task:
+			return true
+		default:
+		}
+		t := time.NewTimer(p.blockTimeout)
+		defer t.Stop()
+		select {
+		case queue <- task:
+			return true
+		case <-t.C:
+		}
+	default:
+		queue <- task
+		return true
+	}
+	p.rejected.Add(1)
+	return false
+}
+
+// Metrics 返回调度器的指标，多个队列时是所有队列的合计
+func (p *WorkerPool) Metrics() DispatcherMetrics {
+	ret := DispatcherMetrics{
+		Processed: p.processed.Load(),
+		Rejected:  p.rejected.Load(),
+	}
+	for _, queue := range p.queues {
+		ret.QueueDepth += len(queue)
+		ret.QueueCapacity += cap(queue)
+	}
+	return ret
+}
+
+// Close 不再接收新的事件，并等待队列中的事件执行完毕
+func (p *WorkerPool) Close() {
+	p.mux.Lock()
+	if p.closed {
+		p.mux.Unlock()
+		return
+	}
+	p.closed = true
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.mux.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,259 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package mainSocket
+
+import (
+	"fmt"
+	"github.com/buexplain/netsvr-protocol-go/v6/netsvrProtocol"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fillWorkerPool 让唯一的worker阻塞在一个事件上，并占满队列，返回放行worker的函数
+func fillWorkerPool(t *testing.T, p *WorkerPool) func() {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	if !p.Dispatch("", func() {
+		close(started)
+		<-release
+	}) {
+		t.Fatal("Dispatch failed")
+	}
+	<-started
+	for i := 0; i < cap(p.queues[0]); i++ {
+		if !p.Dispatch("", func() {}) {
+			t.Fatal("Dispatch failed")
+		}
+	}
+	return func() {
+		close(release)
+	}
+}
+
+func TestWorkerPool_PolicyDrop(t *testing.T) {
+	p := NewWorkerPool(1, 2, PolicyDrop, 0)
+	release := fillWorkerPool(t, p)
+	if p.Dispatch("", func() {}) {
+		t.Error("Dispatch should drop the event when the queue is full")
+	}
+	if m := p.Metrics(); m.QueueDepth != 2 || m.QueueCapacity != 2 || m.Rejected != 1 {
+		t.Error("unexpected metrics", m)
+	}
+	release()
+	p.Close()
+	if m := p.Metrics(); m.QueueDepth != 0 || m.Processed != 3 {
+		t.Error("Close should wait for queued events", m)
+	}
+	if p.Dispatch("", func() {}) || p.Metrics().Rejected != 2 {
+		t.Error("Dispatch should reject events after Close")
+	}
+}
+
+func TestWorkerPool_PolicyBlock(t *testing.T) {
+	p := NewWorkerPool(1, 1, PolicyBlock, time.Millisecond*20)
+	defer p.Close()
+	release := fillWorkerPool(t, p)
+	start := time.Now()
+	if p.Dispatch("", func() {}) {
+		t.Error("Dispatch should drop the event after blockTimeout")
+	}
+	if time.Since(start) < time.Millisecond*20 {
+		t.Error("Dispatch should wait for blockTimeout")
+	}
+	time.AfterFunc(time.Millisecond*5, release)
+	if !p.Dispatch("", func() {}) {
+		t.Error("Dispatch should succeed once the queue has room")
+	}
+}
+
+func TestWorkerPool_PolicyBackpressure(t *testing.T) {
+	p := NewWorkerPool(1, 1, PolicyBackpressure, 0)
+	defer p.Close()
+	release := fillWorkerPool(t, p)
+	time.AfterFunc(time.Millisecond*50, release)
+	start := time.Now()
+	if !p.Dispatch("", func() {}) {
+		t.Error("Dispatch should never drop events")
+	}
+	if time.Since(start) < time.Millisecond*50 {
+		t.Error("Dispatch should wait until the queue has room")
+	}
+}
+
+// countEventForMainSocketTest 统计收到的事件数
+type countEventForMainSocketTest struct {
+	count atomic.Int64
+}
+
+func (e *countEventForMainSocketTest) OnOpen(_ *netsvrProtocol.ConnOpen) {
+	e.count.Add(1)
+}
+
+func (e *countEventForMainSocketTest) OnMessage(_ *netsvrProtocol.Transfer) {
+	e.count.Add(1)
+}
+
+func (e *countEventForMainSocketTest) OnClose(_ *netsvrProtocol.ConnClose) {
+	e.count.Add(1)
+}
+
+func TestMainSocket_WithDispatcher(t *testing.T) {
+	worker := newFakeWorker(t)
+	pool := NewWorkerPool(4, 16, PolicyBackpressure, 0)
+	defer pool.Close()
+	h := new(countEventForMainSocketTest)
+	mainSocket := makeMainSocketForFakeWorker(worker.addr(), h, WithDispatcher(pool))
+	if !mainSocket.Connect() || !mainSocket.Register() {
+		t.Fatal("connect or register failed")
+	}
+	mainSocket.LoopReceive()
+	defer mainSocket.Close()
+	for i := 0; i < 100; i++ {
+		worker.push(netsvrProtocol.Cmd_Transfer, &netsvrProtocol.Transfer{UniqId: "a"})
+	}
+	waitFor(t, func() bool {
+		return h.count.Load() == 100
+	})
+	if m := pool.Metrics(); m.Processed != 100 || m.Rejected != 0 {
+		t.Error("unexpected metrics", m)
+	}
+}
+
+// orderEventForMainSocketTest 按连接记录事件的执行顺序
+type orderEventForMainSocketTest struct {
+	mux    sync.Mutex
+	events map[string][]string
+	count  atomic.Int64
+}
+
+func (e *orderEventForMainSocketTest) record(key string, event string) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.events[key] = append(e.events[key], event)
+	e.count.Add(1)
+}
+
+func (e *orderEventForMainSocketTest) OnOpen(connOpen *netsvrProtocol.ConnOpen) {
+	//OnOpen执行得慢，如果不保证顺序，后续的事件会先执行
+	time.Sleep(time.Millisecond * 10)
+	e.record(connOpen.UniqId, "open")
+}
+
+func (e *orderEventForMainSocketTest) OnMessage(transfer *netsvrProtocol.Transfer) {
+	e.record(transfer.UniqId, string(transfer.Data))
+}
+
+func (e *orderEventForMainSocketTest) OnClose(connClose *netsvrProtocol.ConnClose) {
+	e.record(connClose.UniqId, "close")
+}
+
+func TestMainSocket_WithOrderedDispatcher(t *testing.T) {
+	worker := newFakeWorker(t)
+	pool := NewOrderedWorkerPool(4, 16, PolicyBackpressure, 0)
+	defer pool.Close()
+	h := &orderEventForMainSocketTest{events: make(map[string][]string)}
+	mainSocket := makeMainSocketForFakeWorker(worker.addr(), h, WithDispatcher(pool))
+	if !mainSocket.Connect() || !mainSocket.Register() {
+		t.Fatal("connect or register failed")
+	}
+	mainSocket.LoopReceive()
+	defer mainSocket.Close()
+	expected := make([]string, 0, 22)
+	expected = append(expected, "open")
+	for i := 0; i < 20; i++ {
+		expected = append(expected, strconv.Itoa(i))
+	}
+	expected = append(expected, "close")
+	uniqIds := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, uniqId := range uniqIds {
+		worker.push(netsvrProtocol.Cmd_ConnOpen, &netsvrProtocol.ConnOpen{UniqId: uniqId})
+	}
+	for i := 0; i < 20; i++ {
+		for _, uniqId := range uniqIds {
+			worker.push(netsvrProtocol.Cmd_Transfer, &netsvrProtocol.Transfer{UniqId: uniqId, Data: []byte(strconv.Itoa(i))})
+		}
+	}
+	for _, uniqId := range uniqIds {
+		worker.push(netsvrProtocol.Cmd_ConnClose, &netsvrProtocol.ConnClose{UniqId: uniqId})
+	}
+	waitFor(t, func() bool {
+		return h.count.Load() == int64(len(uniqIds)*len(expected))
+	})
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for _, uniqId := range uniqIds {
+		if fmt.Sprint(h.events[uniqId]) != fmt.Sprint(expected) {
+			t.Error("events out of order", uniqId, h.events[uniqId])
+		}
+	}
+}
+
+func TestMainSocket_Key(t *testing.T) {
+	mainSocket, _, _, _ := makeMainSocket()
+	if mainSocket.key("uniqId", "customerId") != "uniqId" {
+		t.Error("default dispatch key should be uniqId")
+	}
+	WithDispatchKey(DispatchKeyCustomerId)(mainSocket)
+	if mainSocket.key("uniqId", "customerId") != "customerId" || mainSocket.key("uniqId", "") != "uniqId" {
+		t.Error("dispatch key should be customerId and fall back to uniqId")
+	}
+}
+
+// keyDispatcher 记录每个事件的key，然后同步执行
+type keyDispatcher struct {
+	mux  sync.Mutex
+	keys []string
+}
+
+func (d *keyDispatcher) Dispatch(key string, task func()) bool {
+	d.mux.Lock()
+	d.keys = append(d.keys, key)
+	d.mux.Unlock()
+	task()
+	return true
+}
+
+func (d *keyDispatcher) get() []string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return append([]string(nil), d.keys...)
+}
+
+func TestMainSocket_DispatchKeyCustomerId_Order(t *testing.T) {
+	worker := newFakeWorker(t)
+	dispatcher := &keyDispatcher{}
+	mainSocket := makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest), WithDispatcher(dispatcher), WithDispatchKey(DispatchKeyCustomerId))
+	if !mainSocket.Connect() || !mainSocket.Register() {
+		t.Fatal("connect or register failed")
+	}
+	mainSocket.LoopReceive()
+	defer mainSocket.Close()
+	worker.push(netsvrProtocol.Cmd_ConnOpen, &netsvrProtocol.ConnOpen{UniqId: "u"})
+	worker.push(netsvrProtocol.Cmd_Transfer, &netsvrProtocol.Transfer{UniqId: "u"})
+	worker.push(netsvrProtocol.Cmd_Transfer, &netsvrProtocol.Transfer{UniqId: "u", CustomerId: "c"})
+	worker.push(netsvrProtocol.Cmd_ConnClose, &netsvrProtocol.ConnClose{UniqId: "u", CustomerId: "c"})
+	waitFor(t, func() bool {
+		return len(dispatcher.get()) == 4
+	})
+	//同一个连接绑定customerId前后的事件使用不同的key，有序的调度器不保证它们之间的顺序
+	if keys := dispatcher.get(); fmt.Sprint(keys) != "[u u c c]" {
+		t.Error("dispatch keys mismatch", keys)
+	}
+}
@@ -17,84 +17,249 @@
 package mainSocket
 
 import (
+	"context"
 	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// defaultUnregisterTimeout RemoveGateway、Close等待取消注册的响应的最长时间
+const defaultUnregisterTimeout = time.Second * 5
+
 type Manager struct {
 	pool      map[string]*MainSocket
 	connected atomic.Bool
+	mux       sync.Mutex
+	observer  contract.GatewayObserverInterface
+	//解析网关地址中的主机名，为nil时使用net.DefaultResolver
+	resolver contract.Resolver
 }
 
-func NewManager() *Manager {
-	return &Manager{
+func NewManager(opts ...ManagerOption) *Manager {
+	tmp := &Manager{
 		pool:      make(map[string]*MainSocket),
 		connected: atomic.Bool{},
 	}
+	for _, opt := range opts {
+		opt(tmp)
+	}
+	return tmp
 }
 
 func (m *Manager) AddSocket(socket *MainSocket) {
-	m.pool[contract.AddrConvertToHex(socket.GetAddr())] = socket
+	key := m.resolve(socket.GetAddr())
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.attach(socket)
+	m.pool[key] = socket
 }
 
-func (m *Manager) connect() bool {
-	completed := make([]*MainSocket, 0, len(m.pool))
-	ok := true
-	for _, socket := range m.pool {
-		if socket.Connect() {
-			completed = append(completed, socket)
-		} else {
-			ok = false
-			break
+// AddGateway 运行期间动态添加一个网关，如果管理器已经启动，则立即连接、注册，并开启心跳与接收
+// 网关已经存在，或者连接、注册失败，则返回false，连接与注册在锁外进行，不会阻塞管理器的其它方法
+func (m *Manager) AddGateway(socket *MainSocket) bool {
+	key := m.resolve(socket.GetAddr())
+	m.mux.Lock()
+	_, ok := m.pool[key]
+	connected := m.connected.Load()
+	m.mux.Unlock()
+	if ok {
+		return false
+	}
+	m.attach(socket)
+	if connected {
+		if socket.Connect() == false {
+			return false
+		}
+		if socket.Register() == false {
+			socket.Close()
+			return false
 		}
 	}
-	if ok == false {
-		for _, socket := range completed {
+	m.mux.Lock()
+	//连接、注册期间，同一个网关被并发的添加，或者管理器被启动、关闭
+	if _, ok = m.pool[key]; ok || m.connected.Load() != connected {
+		m.mux.Unlock()
+		if connected {
+			ctx, cancel := context.WithTimeout(context.Background(), defaultUnregisterTimeout)
+			socket.UnregisterContext(ctx)
+			cancel()
 			socket.Close()
 		}
 		return false
 	}
+	if connected {
+		socket.LoopReceive()
+		socket.LoopHeartbeat()
+	}
+	m.pool[key] = socket
+	m.mux.Unlock()
 	return true
 }
 
-func (m *Manager) register() bool {
-	completed := make([]*MainSocket, 0, len(m.pool))
-	ok := true
-	for _, socket := range m.pool {
-		if socket.Register() {
-			socket.LoopReceive()
-			socket.LoopHeartbeat()
-			completed = append(completed, socket)
-		} else {
-			ok = false
-			break
+// RemoveGateway 运行期间动态移除一个网关，如果管理器已经启动，则先取消注册再关闭连接，网关不存在则返回false
+// 等待取消注册的响应最多defaultUnregisterTimeout，参见RemoveGatewayContext
+func (m *Manager) RemoveGateway(addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultUnregisterTimeout)
+	defer cancel()
+	return m.RemoveGatewayContext(ctx, addr)
+}
+
+// RemoveGatewayContext 运行期间动态移除一个网关，ctx结束时不再等待取消注册的响应，直接关闭连接
+// 取消注册在锁外进行，被移除的网关不可用时不会阻塞管理器的其它方法
+func (m *Manager) RemoveGatewayContext(ctx context.Context, addr string) bool {
+	m.mux.Lock()
+	key, ok := m.lookup(addr)
+	if !ok {
+		m.mux.Unlock()
+		return false
+	}
+	socket := m.pool[key]
+	delete(m.pool, key)
+	connected := m.connected.Load()
+	m.mux.Unlock()
+	if connected {
+		socket.UnregisterContext(ctx)
+		socket.Close()
+	}
+	return true
+}
+
+// AddrAsHex 返回网关地址对应的16进制字符串，即HasGateway的参数，网关不存在时返回解析后的结果
+func (m *Manager) AddrAsHex(addr string) string {
+	m.mux.Lock()
+	addrAsHex, ok := m.lookup(addr)
+	m.mux.Unlock()
+	if ok {
+		return addrAsHex
+	}
+	return m.resolve(addr)
+}
+
+// HasGateway 是否配置了addrAsHex对应的网关
+func (m *Manager) HasGateway(addrAsHex string) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	_, ok := m.pool[addrAsHex]
+	return ok
+}
+
+// resolve 解析网关地址，失败时退化为contract.AddrConvertToHex
+func (m *Manager) resolve(addr string) string {
+	key, err := contract.ResolveAddrAsHex(context.Background(), m.resolver, addr)
+	if err != nil {
+		log.Error("mainSocketManager resolve "+addr+" failed", "error", err)
+		return contract.AddrConvertToHex(addr)
+	}
+	return key
+}
+
+// lookup 按添加时的网关地址查找，而不是重新解析，避免主机名的解析结果变化后找不到网关，调用方需要持有锁
+func (m *Manager) lookup(addr string) (string, bool) {
+	for key, socket := range m.pool {
+		if socket.GetAddr() == addr {
+			return key, true
 		}
 	}
-	if ok == false {
-		for _, socket := range completed {
+	//写法不同的同一个ip地址
+	key := contract.AddrConvertToHex(addr)
+	_, ok := m.pool[key]
+	return key, ok
+}
+
+// attach 把观察者交给socket，必须在socket开始连接之前调用
+func (m *Manager) attach(socket *MainSocket) {
+	if m.observer != nil {
+		socket.observer = m.observer
+	}
+}
+
+// Count 网关的数量
+func (m *Manager) Count() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return len(m.pool)
+}
+
+// start 并发的连接并注册所有网关，某个网关最终失败时，关闭所有网关，打断其它网关的重试
+func (m *Manager) start(sockets []*MainSocket) bool {
+	var failed atomic.Bool
+	closeAll := sync.OnceFunc(func() {
+		for _, socket := range sockets {
 			socket.Close()
 		}
+	})
+	wg := sync.WaitGroup{}
+	for _, socket := range sockets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if socket.Start() == false {
+				failed.Store(true)
+				closeAll()
+			}
+		}()
+	}
+	wg.Wait()
+	if failed.Load() {
 		return false
 	}
+	for _, socket := range sockets {
+		socket.LoopReceive()
+		socket.LoopHeartbeat()
+	}
 	return true
 }
 
+// Start 连接并注册所有网关，失败时按各个网关的Backoff重试，某个网关的失败次数达到MaxAttempts则关闭所有网关并返回false
+// 默认的Backoff不限制重试次数，网关不可用时Start会一直等待，直到网关可用或者调用Close
 func (m *Manager) Start() bool {
+	m.mux.Lock()
 	if m.connected.CompareAndSwap(false, true) == false {
+		m.mux.Unlock()
+		return true
+	}
+	sockets := make([]*MainSocket, 0, len(m.pool))
+	for _, socket := range m.pool {
+		sockets = append(sockets, socket)
+	}
+	m.mux.Unlock()
+	if m.start(sockets) {
 		return true
 	}
-	m.connected.Store(m.connect() && m.register())
-	return m.connected.Load()
+	m.connected.CompareAndSwap(true, false)
+	return false
 }
 
+// Close 取消所有网关的注册并关闭连接，等待取消注册的响应最多defaultUnregisterTimeout，参见CloseContext
 func (m *Manager) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultUnregisterTimeout)
+	defer cancel()
+	m.CloseContext(ctx)
+}
+
+// CloseContext 取消所有网关的注册并关闭连接，ctx结束时不再等待取消注册的响应，直接关闭连接
+// 取消注册在锁外并发的进行，某个网关不可用时不会阻塞其它网关以及管理器的其它方法
+func (m *Manager) CloseContext(ctx context.Context) {
+	m.mux.Lock()
 	if m.connected.CompareAndSwap(true, false) == false {
+		m.mux.Unlock()
 		return
 	}
+	sockets := make([]*MainSocket, 0, len(m.pool))
 	for _, socket := range m.pool {
-		socket.Unregister()
+		sockets = append(sockets, socket)
 	}
-	for _, socket := range m.pool {
-		socket.Close()
+	m.mux.Unlock()
+	wg := sync.WaitGroup{}
+	for _, socket := range sockets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			socket.UnregisterContext(ctx)
+			socket.Close()
+		}()
 	}
+	wg.Wait()
 }
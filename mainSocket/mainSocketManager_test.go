@@ -17,8 +17,15 @@
 package mainSocket
 
 import (
+	"context"
+	"fmt"
 	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"math"
+	"net"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMainSocketManager_NewManager(t *testing.T) {
@@ -40,6 +47,7 @@ func TestMainSocketManager_AddSocket(t *testing.T) {
 }
 
 func TestMainSocketManager_Start_Close(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6061")
 	tmp := NewManager()
 	mainSocket, _, _, _ := makeMainSocket()
 	tmp.AddSocket(mainSocket)
@@ -61,3 +69,219 @@ func TestMainSocketManager_Start_Close(t *testing.T) {
 		return
 	}
 }
+
+func TestMainSocketManager_AddGateway_RemoveGateway(t *testing.T) {
+	worker := newFakeWorker(t)
+	tmp := NewManager()
+	if tmp.Start() == false {
+		t.Fatal("Start error")
+	}
+	defer tmp.Close()
+	mainSocket := makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest))
+	if tmp.AddGateway(mainSocket) == false {
+		t.Fatal("AddGateway error")
+	}
+	if mainSocket.socket.IsConnected() == false || mainSocket.connId == "" {
+		t.Error("AddGateway should connect and register the gateway")
+	}
+	if tmp.AddGateway(mainSocket) == true || tmp.Count() != 1 {
+		t.Error("AddGateway should reject a duplicate gateway")
+	}
+	if tmp.RemoveGateway(mainSocket.GetAddr()) == false {
+		t.Fatal("RemoveGateway error")
+	}
+	if mainSocket.socket.IsConnected() == true || tmp.Count() != 0 {
+		t.Error("RemoveGateway should close the gateway")
+	}
+	if tmp.RemoveGateway(mainSocket.GetAddr()) == true {
+		t.Error("RemoveGateway should return false for an unknown gateway")
+	}
+}
+
+// observerForMainSocketTest 按顺序记录网关的生命周期事件
+type observerForMainSocketTest struct {
+	mux    sync.Mutex
+	events []string
+}
+
+func (o *observerForMainSocketTest) record(event string) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *observerForMainSocketTest) get() []string {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return append([]string(nil), o.events...)
+}
+
+func (o *observerForMainSocketTest) OnGatewayDisconnected(_ string) {
+	o.record("disconnected")
+}
+
+func (o *observerForMainSocketTest) OnGatewayReconnected(_ string) {
+	o.record("reconnected")
+}
+
+func (o *observerForMainSocketTest) OnGatewayRegistered(_ string, connId string) {
+	if connId == "" {
+		panic("empty connId")
+	}
+	o.record("registered")
+}
+
+func (o *observerForMainSocketTest) OnGatewayUnregistered(_ string) {
+	o.record("unregistered")
+}
+
+func TestMainSocketManager_WithObserver(t *testing.T) {
+	worker := newFakeWorker(t)
+	observer := new(observerForMainSocketTest)
+	tmp := NewManager(WithObserver(observer))
+	tmp.AddSocket(makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest), WithBackoff(Backoff{Min: time.Millisecond, Max: time.Millisecond})))
+	if tmp.Start() == false {
+		t.Fatal("Start error")
+	}
+	worker.kick()
+	waitFor(t, func() bool {
+		return len(observer.get()) == 4
+	})
+	tmp.Close()
+	expected := []string{"registered", "disconnected", "reconnected", "registered", "unregistered"}
+	if events := observer.get(); fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Error("unexpected events", events)
+	}
+}
+
+// fakeResolver 把主机名解析为固定的ip列表
+type fakeResolver map[string][]net.IPAddr
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := r[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestMainSocketManager_WithResolver(t *testing.T) {
+	tmp := NewManager(WithResolver(fakeResolver{"gateway.local": {{IP: net.ParseIP("127.0.0.1")}}}))
+	mainSocket := makeMainSocketForFakeWorker("gateway.local:6061", new(eventForMainSocketTest))
+	tmp.AddSocket(mainSocket)
+	if _, ok := tmp.pool[contract.AddrConvertToHex("127.0.0.1:6061")]; !ok {
+		t.Error("hostname should be resolved")
+	}
+	//无法解析的主机名仍然可以添加，但是无法按uniqId路由
+	tmp.AddSocket(makeMainSocketForFakeWorker("unknown.local:6061", new(eventForMainSocketTest)))
+	if tmp.Count() != 2 {
+		t.Error("unresolvable gateway should still be added")
+	}
+	if tmp.RemoveGateway("gateway.local:6061") == false || tmp.RemoveGateway("unknown.local:6061") == false || tmp.Count() != 0 {
+		t.Error("RemoveGateway should find the gateway by its hostname")
+	}
+}
+
+func TestMainSocketManager_RemoveGatewayContext(t *testing.T) {
+	worker := newFakeWorker(t)
+	worker.ignoreUnregister.Store(true)
+	manager := NewManager()
+	mainSocket := makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest))
+	manager.AddSocket(mainSocket)
+	if !manager.Start() {
+		t.Fatal("Start failed")
+	}
+	defer manager.Close()
+	done := make(chan bool)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		done <- manager.RemoveGatewayContext(ctx, worker.addr())
+	}()
+	//取消注册在锁外等待，不阻塞管理器的其它方法
+	time.Sleep(time.Millisecond * 20)
+	if manager.Count() != 0 {
+		t.Error("gateway should be removed before unregister completes")
+	}
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("RemoveGatewayContext should return true")
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("RemoveGatewayContext should give up after ctx done")
+	}
+	if mainSocket.socket.IsConnected() {
+		t.Error("removed gateway should be closed")
+	}
+}
+
+func TestMainSocketManager_CloseContext(t *testing.T) {
+	worker := newFakeWorker(t)
+	worker.ignoreUnregister.Store(true)
+	manager := NewManager()
+	mainSocket := makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest))
+	manager.AddSocket(mainSocket)
+	if !manager.Start() {
+		t.Fatal("Start failed")
+	}
+	done := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		manager.CloseContext(ctx)
+		close(done)
+	}()
+	//取消注册在锁外等待，不阻塞管理器的其它方法
+	time.Sleep(time.Millisecond * 20)
+	if manager.Count() != 1 {
+		t.Error("Count should not block while unregister is pending")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("CloseContext should give up after ctx done")
+	}
+	if mainSocket.socket.IsConnected() {
+		t.Error("closed gateway should be disconnected")
+	}
+}
+
+func TestMainSocketManager_Start_Retry(t *testing.T) {
+	worker := newFakeWorker(t)
+	worker.rejectRegister.Store(2)
+	manager := NewManager()
+	manager.AddSocket(makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest), WithBackoff(Backoff{Min: time.Millisecond, Max: time.Millisecond})))
+	if !manager.Start() {
+		t.Fatal("Start should retry the rejected register")
+	}
+	defer manager.Close()
+	worker.mux.Lock()
+	defer worker.mux.Unlock()
+	if len(worker.conns) != 1 {
+		t.Error("worker should have one registered conn", len(worker.conns))
+	}
+}
+
+func TestMainSocketManager_Start_MaxAttempts(t *testing.T) {
+	worker := newFakeWorker(t)
+	worker.rejectRegister.Store(math.MaxInt32)
+	manager := NewManager()
+	//不限制重试次数的网关，在另一个网关放弃后被打断
+	manager.AddSocket(makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest), WithBackoff(Backoff{Min: time.Millisecond, Max: time.Millisecond})))
+	manager.AddSocket(makeMainSocketForFakeWorker(testHelper.DeadAddr(t), new(eventForMainSocketTest), WithBackoff(Backoff{Min: time.Millisecond, Max: time.Millisecond, MaxAttempts: 3})))
+	done := make(chan bool, 1)
+	go func() {
+		done <- manager.Start()
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("Start should fail after MaxAttempts")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Start should give up after MaxAttempts")
+	}
+	if manager.connected.Load() {
+		t.Error("manager should not be connected")
+	}
+}
@@ -0,0 +1,65 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package mainSocket
+
+import (
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+)
+
+// Option MainSocket的可选配置
+type Option func(r *MainSocket)
+
+// WithBackoff 设置连接、注册失败后重试的退避策略，默认是DefaultBackoff()，没有设置的Min、Max、Factor使用DefaultBackoff()的值
+func WithBackoff(backoff Backoff) Option {
+	return func(r *MainSocket) {
+		r.backoff = backoff.withDefaults()
+	}
+}
+
+// ManagerOption Manager的可选配置
+type ManagerOption func(m *Manager)
+
+// WithObserver 设置网关的生命周期观察者，Manager会把它交给管理的每个MainSocket
+// 未设置时，如果MainSocket的eventHandler实现了contract.GatewayObserverInterface，则使用eventHandler
+func WithObserver(observer contract.GatewayObserverInterface) ManagerOption {
+	return func(m *Manager) {
+		m.observer = observer
+	}
+}
+
+// WithResolver 设置解析网关地址中的主机名的解析器，默认是net.DefaultResolver
+// 主机名只在添加网关时解析一次
+func WithResolver(resolver contract.Resolver) ManagerOption {
+	return func(m *Manager) {
+		m.resolver = resolver
+	}
+}
+
+// WithDispatcher 设置事件的调度器，默认每个事件一个协程
+func WithDispatcher(dispatcher Dispatcher) Option {
+	return func(r *MainSocket) {
+		r.dispatcher = dispatcher
+	}
+}
+
+// WithDispatchKey 设置传给调度器的key，默认是DispatchKeyUniqId，配合NewOrderedWorkerPool使用
+// DispatchKeyCustomerId不保证同一个连接内事件的顺序，参见DispatchKeyCustomerId
+func WithDispatchKey(dispatchKey DispatchKey) Option {
+	return func(r *MainSocket) {
+		r.dispatchKey = dispatchKey
+	}
+}
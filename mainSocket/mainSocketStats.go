@@ -0,0 +1,63 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package mainSocket
+
+import (
+	"github.com/buexplain/netsvr-protocol-go/v6/netsvrProtocol"
+	"maps"
+	"time"
+)
+
+// Stats 主连接的统计快照
+type Stats struct {
+	//网关地址
+	Addr string
+	//最近一次注册成功时网关分配的连接id
+	ConnId string
+	//当前是否已经连接
+	Connected bool
+	//重连的尝试次数、成功次数
+	ReconnectAttempts  uint64
+	ReconnectSuccesses uint64
+	//按cmd统计的收到的事件数
+	Events map[netsvrProtocol.Cmd]uint64
+	//最近一次收到事件的时间，没有收到过事件时为零值
+	LastEventAt time.Time
+}
+
+// Stats 主连接的统计快照
+func (r *MainSocket) Stats() Stats {
+	r.statsMux.Lock()
+	defer r.statsMux.Unlock()
+	return Stats{
+		Addr:               r.GetAddr(),
+		ConnId:             r.connId,
+		Connected:          r.socket.IsConnected(),
+		ReconnectAttempts:  r.reconnectAttempts.Load(),
+		ReconnectSuccesses: r.reconnectSuccesses.Load(),
+		Events:             maps.Clone(r.eventCounts),
+		LastEventAt:        r.lastEventAt,
+	}
+}
+
+// countEvent 记录收到的事件
+func (r *MainSocket) countEvent(cmd netsvrProtocol.Cmd) {
+	r.statsMux.Lock()
+	r.eventCounts[cmd]++
+	r.lastEventAt = time.Now()
+	r.statsMux.Unlock()
+}
@@ -17,11 +17,17 @@
 package mainSocket
 
 import (
+	"encoding/binary"
 	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
 	"github.com/buexplain/netsvr-business-go/v2/log"
 	"github.com/buexplain/netsvr-business-go/v2/socket"
 	"github.com/buexplain/netsvr-protocol-go/v6/netsvrProtocol"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -77,6 +83,7 @@ func TestMainSocket_GetAddr(t *testing.T) {
 }
 
 func TestMainSocket_Connect(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6061")
 	mainSocket, _, _, _ := makeMainSocket()
 	if mainSocket.Connect() == false {
 		t.Error("Connect failed")
@@ -89,6 +96,7 @@ func TestMainSocket_Connect(t *testing.T) {
 }
 
 func TestMainSocket_Register_Unregister(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6061")
 	mainSocket, _, _, _ := makeMainSocket()
 	if mainSocket.Connect() == false {
 		t.Error("Connect failed")
@@ -109,3 +117,170 @@ func TestMainSocket_Register_Unregister(t *testing.T) {
 		t.Error("Unregister failed")
 	}
 }
+
+// fakeWorker 模拟网关的worker服务器，响应注册与取消注册，并可以向已注册的连接推送事件
+type fakeWorker struct {
+	ln    net.Listener
+	mux   sync.Mutex
+	conns []net.Conn
+	//为true时不响应取消注册，模拟半开的连接
+	ignoreUnregister atomic.Bool
+	//大于0时拒绝注册并减一，模拟网关暂时不接受注册
+	rejectRegister atomic.Int32
+}
+
+func newFakeWorker(t testing.TB) *fakeWorker {
+	w := &fakeWorker{}
+	w.ln = testHelper.Listen(t, w.serve)
+	t.Cleanup(w.close)
+	return w
+}
+
+func (w *fakeWorker) addr() string {
+	return w.ln.Addr().String()
+}
+
+func (w *fakeWorker) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	for {
+		body, err := testHelper.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		if len(body) < 4 {
+			continue
+		}
+		switch netsvrProtocol.Cmd(binary.BigEndian.Uint32(body[0:4])) {
+		case netsvrProtocol.Cmd_Register:
+			if w.rejectRegister.Add(-1) >= 0 {
+				_ = testHelper.WriteCmd(conn, netsvrProtocol.Cmd_Register, &netsvrProtocol.RegisterResp{Code: 1, Message: "rejected"})
+				continue
+			}
+			w.mux.Lock()
+			w.conns = append(w.conns, conn)
+			w.mux.Unlock()
+			_ = testHelper.WriteCmd(conn, netsvrProtocol.Cmd_Register, &netsvrProtocol.RegisterResp{ConnId: conn.RemoteAddr().String()})
+		case netsvrProtocol.Cmd_Unregister:
+			if w.ignoreUnregister.Load() {
+				continue
+			}
+			_ = testHelper.WriteCmd(conn, netsvrProtocol.Cmd_Unregister, &netsvrProtocol.UnRegisterResp{})
+		}
+	}
+}
+
+// push 向所有已注册的连接推送事件
+func (w *fakeWorker) push(cmd netsvrProtocol.Cmd, message proto.Message) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	for _, conn := range w.conns {
+		_ = testHelper.WriteCmd(conn, cmd, message)
+	}
+}
+
+// kick 断开所有已注册的连接，模拟网关重启
+func (w *fakeWorker) kick() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	for _, conn := range w.conns {
+		_ = conn.Close()
+	}
+	w.conns = nil
+}
+
+// close 关闭监听以及所有已注册的连接
+func (w *fakeWorker) close() {
+	_ = w.ln.Close()
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	for _, conn := range w.conns {
+		_ = conn.Close()
+	}
+	w.conns = nil
+}
+
+func makeMainSocketForFakeWorker(addr string, h contract.EventInterface, opts ...Option) *MainSocket {
+	sk := socket.New(addr, time.Second*25, time.Second*25, time.Second*25)
+	events := netsvrProtocol.Event_OnOpen | netsvrProtocol.Event_OnClose | netsvrProtocol.Event_OnMessage
+	return New(h, sk, []byte("~6YOt5rW35piO~"), events, time.Second*25, opts...)
+}
+
+// waitFor 等待cond成立，超时则测试失败
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("wait timeout")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestMainSocket_Reconnect(t *testing.T) {
+	worker := newFakeWorker(t)
+	mainSocket := makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest), WithBackoff(Backoff{Min: time.Millisecond * 10, Max: time.Millisecond * 20, Factor: 2, Jitter: 0.5}))
+	if !mainSocket.Connect() || !mainSocket.Register() {
+		t.Fatal("connect or register failed")
+	}
+	mainSocket.LoopReceive()
+	defer mainSocket.Close()
+	worker.kick()
+	waitFor(t, func() bool {
+		return mainSocket.ReconnectSuccesses() == 1
+	})
+	if mainSocket.ReconnectAttempts() < 1 || !mainSocket.socket.IsConnected() {
+		t.Error("reconnect failed")
+	}
+}
+
+func TestMainSocket_Reconnect_MaxAttempts(t *testing.T) {
+	worker := newFakeWorker(t)
+	mainSocket := makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest), WithBackoff(Backoff{Min: time.Millisecond, Max: time.Millisecond, MaxAttempts: 3}))
+	if !mainSocket.Connect() || !mainSocket.Register() {
+		t.Fatal("connect or register failed")
+	}
+	mainSocket.LoopReceive()
+	defer mainSocket.Close()
+	worker.close()
+	waitFor(t, func() bool {
+		return mainSocket.ReconnectAttempts() == 3
+	})
+	time.Sleep(time.Millisecond * 50)
+	if mainSocket.ReconnectAttempts() != 3 || mainSocket.ReconnectSuccesses() != 0 {
+		t.Error("reconnect should give up after MaxAttempts", mainSocket.ReconnectAttempts())
+	}
+}
+
+func TestMainSocket_Stats(t *testing.T) {
+	worker := newFakeWorker(t)
+	mainSocket := makeMainSocketForFakeWorker(worker.addr(), new(eventForMainSocketTest))
+	if stats := mainSocket.Stats(); stats.Connected || stats.ConnId != "" || !stats.LastEventAt.IsZero() {
+		t.Error("stats before connect mismatch", stats)
+	}
+	if !mainSocket.Connect() || !mainSocket.Register() {
+		t.Fatal("connect or register failed")
+	}
+	mainSocket.LoopReceive()
+	defer mainSocket.Close()
+	worker.push(netsvrProtocol.Cmd_ConnOpen, &netsvrProtocol.ConnOpen{UniqId: "a"})
+	worker.push(netsvrProtocol.Cmd_ConnOpen, &netsvrProtocol.ConnOpen{UniqId: "b"})
+	worker.push(netsvrProtocol.Cmd_ConnClose, &netsvrProtocol.ConnClose{UniqId: "a"})
+	waitFor(t, func() bool {
+		return mainSocket.Stats().Events[netsvrProtocol.Cmd_ConnClose] == 1
+	})
+	stats := mainSocket.Stats()
+	if stats.Addr != worker.addr() || !stats.Connected || stats.ConnId == "" {
+		t.Error("stats of connection mismatch", stats)
+	}
+	if stats.Events[netsvrProtocol.Cmd_ConnOpen] != 2 || stats.LastEventAt.IsZero() {
+		t.Error("stats of events mismatch", stats.Events, stats.LastEventAt)
+	}
+	//快照与内部的计数互不影响
+	stats.Events[netsvrProtocol.Cmd_ConnOpen] = 0
+	if mainSocket.Stats().Events[netsvrProtocol.Cmd_ConnOpen] != 2 {
+		t.Error("Stats should return a copy of events")
+	}
+}
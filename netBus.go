@@ -17,27 +17,42 @@
 package netsvrBusiness
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/buexplain/netsvr-business-go/v2/contract"
-	"github.com/buexplain/netsvr-business-go/v2/log"
 	"github.com/buexplain/netsvr-business-go/v2/ret"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
 	"github.com/buexplain/netsvr-business-go/v2/taskSocket"
 	"github.com/buexplain/netsvr-protocol-go/v6/netsvrProtocol"
 	"google.golang.org/protobuf/proto"
+	"sync"
+	"time"
 )
 
 type NetBus struct {
 	taskSocketPoolManger *taskSocket.Manger
+	//向多个网关请求时的最大并发数，小于等于0表示不限制
+	concurrency int
+	//是否跳过不可用的网关，只给可用的网关发送数据
+	partialAvailability bool
+	//是否通过有序通道发送单向指令
+	orderedDelivery bool
+	//是否通过异步写入器发送单向指令
+	asyncSend bool
 }
 
-func NewNetBus(taskSocketPoolManger *taskSocket.Manger) *NetBus {
+func NewNetBus(taskSocketPoolManger *taskSocket.Manger, opts ...Option) *NetBus {
 	if taskSocketPoolManger == nil {
 		panic("taskSocketPoolManger is nil")
 	}
-	return &NetBus{
+	tmp := &NetBus{
 		taskSocketPoolManger: taskSocketPoolManger,
 	}
+	for _, opt := range opts {
+		opt(tmp)
+	}
+	return tmp
 }
 
 // Close 关闭网关
@@ -45,97 +60,124 @@ func (n *NetBus) Close() {
 	n.taskSocketPoolManger.Close()
 }
 
+// CloseContext 关闭与所有网关的连接，等待借出的socket归还，直到ctx结束，参见taskSocket.Pool.CloseContext
+func (n *NetBus) CloseContext(ctx context.Context) error {
+	return n.taskSocketPoolManger.CloseContext(ctx)
+}
+
 // ConnInfoUpdate 更新客户在网关存储的信息
-func (n *NetBus) ConnInfoUpdate(connInfoUpdate *netsvrProtocol.ConnInfoUpdate) {
-	message := n.pack(netsvrProtocol.Cmd_ConnInfoUpdate, connInfoUpdate)
-	n.sendToSocketByUniqId(connInfoUpdate.GetUniqId(), message)
+func (n *NetBus) ConnInfoUpdate(ctx context.Context, connInfoUpdate *netsvrProtocol.ConnInfoUpdate) error {
+	message, err := n.pack(netsvrProtocol.Cmd_ConnInfoUpdate, connInfoUpdate)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSocketByUniqId(ctx, connInfoUpdate.GetUniqId(), message)
 }
 
 // ConnInfoDelete 删除目标uniqId在网关中存储的信息
-func (n *NetBus) ConnInfoDelete(connInfoDelete *netsvrProtocol.ConnInfoDelete) {
-	message := n.pack(netsvrProtocol.Cmd_ConnInfoDelete, connInfoDelete)
-	n.sendToSocketByUniqId(connInfoDelete.GetUniqId(), message)
+func (n *NetBus) ConnInfoDelete(ctx context.Context, connInfoDelete *netsvrProtocol.ConnInfoDelete) error {
+	message, err := n.pack(netsvrProtocol.Cmd_ConnInfoDelete, connInfoDelete)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSocketByUniqId(ctx, connInfoDelete.GetUniqId(), message)
 }
 
 // Broadcast 广播
-func (n *NetBus) Broadcast(data []byte) {
+func (n *NetBus) Broadcast(ctx context.Context, data []byte) error {
 	broadcast := netsvrProtocol.Broadcast{
 		Data: data,
 	}
-	message := n.pack(netsvrProtocol.Cmd_Broadcast, &broadcast)
-	n.sendToSockets(message)
+	message, err := n.pack(netsvrProtocol.Cmd_Broadcast, &broadcast)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSockets(ctx, "", message)
 }
 
 // Multicast 按uniqId组播
-func (n *NetBus) Multicast(uniqIds []string, data []byte) {
-	if n.isSinglePoint() || len(uniqIds) == 1 {
-		multicast := netsvrProtocol.Multicast{
-			UniqIds: uniqIds,
-			Data:    data,
-		}
-		message := n.pack(netsvrProtocol.Cmd_Multicast, &multicast)
-		n.sendToSocketByUniqId(uniqIds[0], message)
-		return
-	}
-	group := n.getUniqIdsGroupByAddrAsHex(uniqIds)
+func (n *NetBus) Multicast(ctx context.Context, uniqIds []string, data []byte) error {
+	group, routeErr := n.routeUniqIds(uniqIds)
+	errs := []error{routeErr}
 	for addrAsHex, currentUniqIds := range group {
 		multicast := netsvrProtocol.Multicast{
 			UniqIds: currentUniqIds,
 			Data:    data,
 		}
-		message := n.pack(netsvrProtocol.Cmd_Multicast, &multicast)
-		n.sendToSocketByAddrAsHex(addrAsHex, message)
+		message, err := n.pack(netsvrProtocol.Cmd_Multicast, &multicast)
+		if err != nil {
+			//保留已经收集的错误，调用方才能知道哪些网关已经发送
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, n.sendToSocketByAddrAsHex(ctx, addrAsHex, orderKey(currentUniqIds), message))
+		message.Release()
 	}
+	return errors.Join(errs...)
 }
 
 // MulticastByCustomerId 按customerId组播
-func (n *NetBus) MulticastByCustomerId(customerIds []string, data []byte) {
+func (n *NetBus) MulticastByCustomerId(ctx context.Context, customerIds []string, data []byte) error {
 	multicastByCustomerId := netsvrProtocol.MulticastByCustomerId{}
 	multicastByCustomerId.CustomerIds = customerIds
 	multicastByCustomerId.Data = data
-	message := n.pack(netsvrProtocol.Cmd_MulticastByCustomerId, &multicastByCustomerId)
+	message, err := n.pack(netsvrProtocol.Cmd_MulticastByCustomerId, &multicastByCustomerId)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
 	//因为不知道客户id在哪个网关，所以给所有网关发送
-	n.sendToSockets(message)
+	return n.sendToSockets(ctx, orderKey(customerIds), message)
 }
 
 // SingleCast 按uniqId单播
-func (n *NetBus) SingleCast(uniqId string, data []byte) {
+func (n *NetBus) SingleCast(ctx context.Context, uniqId string, data []byte) error {
 	singleCast := netsvrProtocol.SingleCast{
 		UniqId: uniqId,
 		Data:   data,
 	}
-	message := n.pack(netsvrProtocol.Cmd_SingleCast, &singleCast)
-	n.sendToSocketByUniqId(uniqId, message)
+	message, err := n.pack(netsvrProtocol.Cmd_SingleCast, &singleCast)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSocketByUniqId(ctx, uniqId, message)
 }
 
 // SingleCastByCustomerId 按customerId单播
-func (n *NetBus) SingleCastByCustomerId(customerId string, data []byte) {
+func (n *NetBus) SingleCastByCustomerId(ctx context.Context, customerId string, data []byte) error {
 	singleCastByCustomerId := netsvrProtocol.SingleCastByCustomerId{}
 	singleCastByCustomerId.CustomerId = customerId
 	singleCastByCustomerId.Data = data
-	message := n.pack(netsvrProtocol.Cmd_SingleCastByCustomerId, &singleCastByCustomerId)
-	n.sendToSockets(message)
+	message, err := n.pack(netsvrProtocol.Cmd_SingleCastByCustomerId, &singleCastByCustomerId)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSockets(ctx, customerId, message)
 }
 
 // SingleCastBulk 按uniqId批量单播，一次性给多个用户发送不同的消息，或给一个用户发送多条消息
-func (n *NetBus) SingleCastBulk(uniqIds []string, data [][]byte) {
-	//网关是单机部署或者是只给一个用户发消息，则直接构造批量单播对象发送
-	if n.isSinglePoint() || len(uniqIds) == 1 {
-		singleCastBulk := netsvrProtocol.SingleCastBulk{}
-		singleCastBulk.Data = data
-		singleCastBulk.UniqIds = uniqIds
-		message := n.pack(netsvrProtocol.Cmd_SingleCastBulk, &singleCastBulk)
-		n.sendToSocketByUniqId(uniqIds[0], message)
-		return
+// 格式不正确或者所在网关没有配置的uniqId会被跳过，并通过*contract.UniqIdError返回
+func (n *NetBus) SingleCastBulk(ctx context.Context, uniqIds []string, data [][]byte) error {
+	if len(uniqIds) == 0 {
+		return nil
 	}
-	//网关是多机器部署，或者是发个多个uniqId，需要迭代每一个uniqId，并根据所在网关进行分组，然后再迭代每一个组，将数据发送到对应网关
+	//需要迭代每一个uniqId，并根据所在网关进行分组，然后再迭代每一个组，将数据发送到对应网关
 	type bulk struct {
 		uniqIds []string
 		data    [][]byte
 	}
 	bulks := make(map[string]*bulk)
+	failures := routeFailures{}
 	for index, uniqId := range uniqIds {
-		addrAsHex := contract.UniqIdConvertToAddrAsHex(uniqId)
+		addrAsHex := n.routeUniqId(uniqId, &failures)
+		if addrAsHex == "" {
+			continue
+		}
 		if b, ok := bulks[addrAsHex]; ok {
 			b.uniqIds = append(b.uniqIds, uniqId)
 			b.data = append(b.data, data[index])
@@ -147,690 +189,652 @@ func (n *NetBus) SingleCastBulk(uniqIds []string, data [][]byte) {
 			bulks[addrAsHex] = b
 		}
 	}
+	errs := []error{failures.err()}
 	//分组完毕，循环发送到各个网关
 	for addrAsHex, b := range bulks {
 		singleCastBulk := netsvrProtocol.SingleCastBulk{}
 		singleCastBulk.Data = b.data
 		singleCastBulk.UniqIds = b.uniqIds
-		n.sendToSocketByAddrAsHex(addrAsHex, n.pack(netsvrProtocol.Cmd_SingleCastBulk, &singleCastBulk))
+		message, err := n.pack(netsvrProtocol.Cmd_SingleCastBulk, &singleCastBulk)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, n.sendToSocketByAddrAsHex(ctx, addrAsHex, orderKey(b.uniqIds), message))
+		message.Release()
 	}
+	return errors.Join(errs...)
 }
 
 // SingleCastBulkByCustomerId 按customerId批量单播，一次性给多个用户发送不同的消息，或给一个用户发送多条消息
-func (n *NetBus) SingleCastBulkByCustomerId(customerIds []string, data [][]byte) {
+func (n *NetBus) SingleCastBulkByCustomerId(ctx context.Context, customerIds []string, data [][]byte) error {
 	singleCastBulkByCustomerId := netsvrProtocol.SingleCastBulkByCustomerId{}
 	singleCastBulkByCustomerId.CustomerIds = customerIds
 	singleCastBulkByCustomerId.Data = data
-	message := n.pack(netsvrProtocol.Cmd_SingleCastBulkByCustomerId, &singleCastBulkByCustomerId)
-	n.sendToSockets(message)
+	message, err := n.pack(netsvrProtocol.Cmd_SingleCastBulkByCustomerId, &singleCastBulkByCustomerId)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSockets(ctx, orderKey(customerIds), message)
 }
 
 // TopicSubscribe 订阅若干个主题
-func (n *NetBus) TopicSubscribe(uniqId string, topics []string, data []byte) {
+func (n *NetBus) TopicSubscribe(ctx context.Context, uniqId string, topics []string, data []byte) error {
 	topicSubscribe := netsvrProtocol.TopicSubscribe{}
 	topicSubscribe.UniqId = uniqId
 	topicSubscribe.Topics = topics
 	topicSubscribe.Data = data
-	message := n.pack(netsvrProtocol.Cmd_TopicSubscribe, &topicSubscribe)
-	n.sendToSocketByUniqId(uniqId, message)
+	message, err := n.pack(netsvrProtocol.Cmd_TopicSubscribe, &topicSubscribe)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSocketByUniqId(ctx, uniqId, message)
 }
 
 // TopicUnsubscribe 取消若干个已订阅的主题
-func (n *NetBus) TopicUnsubscribe(uniqId string, topics []string, data []byte) {
+func (n *NetBus) TopicUnsubscribe(ctx context.Context, uniqId string, topics []string, data []byte) error {
 	topicUnsubscribe := netsvrProtocol.TopicUnsubscribe{}
 	topicUnsubscribe.UniqId = uniqId
 	topicUnsubscribe.Topics = topics
 	topicUnsubscribe.Data = data
-	message := n.pack(netsvrProtocol.Cmd_TopicUnsubscribe, &topicUnsubscribe)
-	n.sendToSocketByUniqId(uniqId, message)
+	message, err := n.pack(netsvrProtocol.Cmd_TopicUnsubscribe, &topicUnsubscribe)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSocketByUniqId(ctx, uniqId, message)
 }
 
 // TopicDelete 删除若干个主题
-func (n *NetBus) TopicDelete(topics []string, data []byte) {
+func (n *NetBus) TopicDelete(ctx context.Context, topics []string, data []byte) error {
 	topicDelete := netsvrProtocol.TopicDelete{}
 	topicDelete.Topics = topics
 	topicDelete.Data = data
-	message := n.pack(netsvrProtocol.Cmd_TopicDelete, &topicDelete)
-	n.sendToSockets(message)
+	message, err := n.pack(netsvrProtocol.Cmd_TopicDelete, &topicDelete)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSockets(ctx, "", message)
 }
 
 // TopicPublish 发布若干个主题
-func (n *NetBus) TopicPublish(topics []string, data []byte) {
+func (n *NetBus) TopicPublish(ctx context.Context, topics []string, data []byte) error {
 	topicPublish := netsvrProtocol.TopicPublish{}
 	topicPublish.Topics = topics
 	topicPublish.Data = data
-	message := n.pack(netsvrProtocol.Cmd_TopicPublish, &topicPublish)
-	n.sendToSockets(message)
+	message, err := n.pack(netsvrProtocol.Cmd_TopicPublish, &topicPublish)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSockets(ctx, "", message)
 }
 
 // TopicPublishBulk 批量发布，一次性给多个主题发送不同的消息，或给一个主题发送多条消息
-func (n *NetBus) TopicPublishBulk(topics []string, data [][]byte) {
+func (n *NetBus) TopicPublishBulk(ctx context.Context, topics []string, data [][]byte) error {
 	topicPublishBulk := netsvrProtocol.TopicPublishBulk{}
 	topicPublishBulk.Data = data
 	topicPublishBulk.Topics = topics
-	message := n.pack(netsvrProtocol.Cmd_TopicPublishBulk, &topicPublishBulk)
-	n.sendToSockets(message)
+	message, err := n.pack(netsvrProtocol.Cmd_TopicPublishBulk, &topicPublishBulk)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
+	return n.sendToSockets(ctx, "", message)
 }
 
 // ForceOffline 强制关闭某几个连接
-func (n *NetBus) ForceOffline(uniqIds []string, data []byte) {
-	if n.isSinglePoint() || len(uniqIds) == 1 {
-		forceOffline := netsvrProtocol.ForceOffline{}
-		forceOffline.UniqIds = uniqIds
-		forceOffline.Data = data
-		n.sendToSocketByUniqId(uniqIds[0], n.pack(netsvrProtocol.Cmd_ForceOffline, &forceOffline))
-		return
-	}
-	group := n.getUniqIdsGroupByAddrAsHex(uniqIds)
+func (n *NetBus) ForceOffline(ctx context.Context, uniqIds []string, data []byte) error {
+	group, routeErr := n.routeUniqIds(uniqIds)
+	errs := []error{routeErr}
 	for addrAsHex, currentUniqIds := range group {
 		forceOffline := netsvrProtocol.ForceOffline{}
 		forceOffline.UniqIds = currentUniqIds
 		forceOffline.Data = data
-		n.sendToSocketByAddrAsHex(addrAsHex, n.pack(netsvrProtocol.Cmd_ForceOffline, &forceOffline))
+		message, err := n.pack(netsvrProtocol.Cmd_ForceOffline, &forceOffline)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, n.sendToSocketByAddrAsHex(ctx, addrAsHex, orderKey(currentUniqIds), message))
+		message.Release()
 	}
+	return errors.Join(errs...)
 }
 
 // ForceOfflineByCustomerId 强制关闭某几个customerId
-func (n *NetBus) ForceOfflineByCustomerId(customerIds []string, data []byte) {
+func (n *NetBus) ForceOfflineByCustomerId(ctx context.Context, customerIds []string, data []byte) error {
 	forceOfflineByCustomerId := netsvrProtocol.ForceOfflineByCustomerId{}
 	forceOfflineByCustomerId.CustomerIds = customerIds
 	forceOfflineByCustomerId.Data = data
-	message := n.pack(netsvrProtocol.Cmd_ForceOfflineByCustomerId, &forceOfflineByCustomerId)
+	message, err := n.pack(netsvrProtocol.Cmd_ForceOfflineByCustomerId, &forceOfflineByCustomerId)
+	if err != nil {
+		return err
+	}
+	defer message.Release()
 	//因为不知道客户id在哪个网关，所以给所有网关发送
-	n.sendToSockets(message)
+	return n.sendToSockets(ctx, orderKey(customerIds), message)
 }
 
 // ForceOfflineGuest 强制关闭某几个空session值的连接
-func (n *NetBus) ForceOfflineGuest(uniqIds []string, data []byte, delay int32) {
-	if n.isSinglePoint() || len(uniqIds) == 1 {
-		forceOfflineGuest := netsvrProtocol.ForceOfflineGuest{}
-		forceOfflineGuest.UniqIds = uniqIds
-		forceOfflineGuest.Data = data
-		forceOfflineGuest.Delay = delay
-		n.sendToSocketByUniqId(uniqIds[0], n.pack(netsvrProtocol.Cmd_ForceOfflineGuest, &forceOfflineGuest))
-		return
-	}
-	group := n.getUniqIdsGroupByAddrAsHex(uniqIds)
+func (n *NetBus) ForceOfflineGuest(ctx context.Context, uniqIds []string, data []byte, delay int32) error {
+	group, routeErr := n.routeUniqIds(uniqIds)
+	errs := []error{routeErr}
 	for addrAsHex, currentUniqIds := range group {
 		forceOfflineGuest := netsvrProtocol.ForceOfflineGuest{}
 		forceOfflineGuest.UniqIds = currentUniqIds
 		forceOfflineGuest.Data = data
 		forceOfflineGuest.Delay = delay
-		n.sendToSocketByAddrAsHex(addrAsHex, n.pack(netsvrProtocol.Cmd_ForceOfflineGuest, &forceOfflineGuest))
+		message, err := n.pack(netsvrProtocol.Cmd_ForceOfflineGuest, &forceOfflineGuest)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, n.sendToSocketByAddrAsHex(ctx, addrAsHex, orderKey(currentUniqIds), message))
+		message.Release()
 	}
+	return errors.Join(errs...)
 }
 
 // CheckOnline 检查目标uniqId是否在线
-func (n *NetBus) CheckOnline(uniqIds []string) *ret.CheckOnlineRet {
-	res := ret.CheckOnlineRet{Data: make(map[string]*netsvrProtocol.CheckOnlineResp)}
-	if n.isSinglePoint() || len(uniqIds) == 1 {
-		socket := n.getTaskSocketByUniqId(uniqIds[0])
-		if socket == nil {
-			return &res
-		}
-		defer socket.Release()
-		checkOnlineReq := netsvrProtocol.CheckOnlineReq{}
-		checkOnlineReq.UniqIds = uniqIds
-		socket.Send(n.pack(netsvrProtocol.Cmd_CheckOnline, &checkOnlineReq))
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::CheckOnline failed because the connection to the netsvr was disconnected")
-			return &res
-		}
-		checkOnlineResp := &netsvrProtocol.CheckOnlineResp{}
-		if err := proto.Unmarshal(respData[4:], checkOnlineResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.CheckOnlineResp failed", "error", err)
-			return &res
-		}
-		res.Data[socket.GetAddr()] = checkOnlineResp
-		return &res
-	}
-	group := n.getUniqIdsGroupByAddrAsHex(uniqIds)
-	fn := func(socket *taskSocket.TaskSocket, currentUniqIds []string) {
-		defer socket.Release()
-		checkOnlineReq := netsvrProtocol.CheckOnlineReq{}
-		checkOnlineReq.UniqIds = currentUniqIds
-		socket.Send(n.pack(netsvrProtocol.Cmd_CheckOnline, &checkOnlineReq))
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::CheckOnline failed because the connection to the netsvr was disconnected")
-			return
-		}
-		checkOnlineResp := &netsvrProtocol.CheckOnlineResp{}
-		if err := proto.Unmarshal(respData[4:], checkOnlineResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.CheckOnlineResp failed", "error", err)
-			return
-		}
-		res.Data[socket.GetAddr()] = checkOnlineResp
-	}
+func (n *NetBus) CheckOnline(ctx context.Context, uniqIds []string) (*ret.CheckOnlineRet, error) {
+	group, routeErr := n.routeUniqIds(uniqIds)
+	reqs := make(map[string]proto.Message, len(group))
 	for addrAsHex, currentUniqIds := range group {
-		socket := n.taskSocketPoolManger.GetSocket(addrAsHex)
-		if socket == nil {
-			continue
-		}
-		fn(socket, currentUniqIds)
+		reqs[addrAsHex] = &netsvrProtocol.CheckOnlineReq{UniqIds: currentUniqIds}
 	}
-	return &res
+	data, gateways, err := queryGroup[netsvrProtocol.CheckOnlineResp](ctx, n, netsvrProtocol.Cmd_CheckOnline, reqs, groupAddrs(group))
+	return &ret.CheckOnlineRet{Gateways: gateways, Data: data}, errors.Join(routeErr, err)
 }
 
 // UniqIdList 获取所有网关中存储的uniqId
-func (n *NetBus) UniqIdList() *ret.UniqIdListRet {
-	res := ret.UniqIdListRet{Data: make(map[string]*netsvrProtocol.UniqIdListResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_UniqIdList, nil)
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::UniqIdList failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		uniqIdListResp := &netsvrProtocol.UniqIdListResp{}
-		if err := proto.Unmarshal(respData[4:], uniqIdListResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.UniqIdListResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = uniqIdListResp
-	}
-	return &res
+func (n *NetBus) UniqIdList(ctx context.Context) (*ret.UniqIdListRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.UniqIdListResp](ctx, n, netsvrProtocol.Cmd_UniqIdList, nil)
+	return &ret.UniqIdListRet{Gateways: gateways, Data: data}, err
 }
 
 // UniqIdCount 获取所有网关中存储的uniqId数量
-func (n *NetBus) UniqIdCount() *ret.UniqIdCountRet {
-	res := ret.UniqIdCountRet{Data: make(map[string]*netsvrProtocol.UniqIdCountResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_UniqIdCount, nil)
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::UniqIdCount failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		uniqIdCountResp := &netsvrProtocol.UniqIdCountResp{}
-		if err := proto.Unmarshal(respData[4:], uniqIdCountResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.UniqIdCountResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = uniqIdCountResp
-	}
-	return &res
+func (n *NetBus) UniqIdCount(ctx context.Context) (*ret.UniqIdCountRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.UniqIdCountResp](ctx, n, netsvrProtocol.Cmd_UniqIdCount, nil)
+	return &ret.UniqIdCountRet{Gateways: gateways, Data: data}, err
 }
 
 // TopicCount 获取所有网关中存储的topic数量
-func (n *NetBus) TopicCount() *ret.TopicCountRet {
-	res := ret.TopicCountRet{Data: make(map[string]*netsvrProtocol.TopicCountResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_TopicCount, nil)
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::TopicCount failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		topicCountResp := &netsvrProtocol.TopicCountResp{}
-		if err := proto.Unmarshal(respData[4:], topicCountResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.TopicCountResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = topicCountResp
-	}
-	return &res
+func (n *NetBus) TopicCount(ctx context.Context) (*ret.TopicCountRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.TopicCountResp](ctx, n, netsvrProtocol.Cmd_TopicCount, nil)
+	return &ret.TopicCountRet{Gateways: gateways, Data: data}, err
 }
 
 // TopicList 获取所有网关中存储的topic
-func (n *NetBus) TopicList() *ret.TopicListRet {
-	res := ret.TopicListRet{Data: make(map[string]*netsvrProtocol.TopicListResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_TopicList, nil)
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::TopicList failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		topicListResp := &netsvrProtocol.TopicListResp{}
-		if err := proto.Unmarshal(respData[4:], topicListResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.TopicListResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = topicListResp
-	}
-	return &res
+func (n *NetBus) TopicList(ctx context.Context) (*ret.TopicListRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.TopicListResp](ctx, n, netsvrProtocol.Cmd_TopicList, nil)
+	return &ret.TopicListRet{Gateways: gateways, Data: data}, err
 }
 
 // TopicUniqIdList 获取所有网关中存储的topic对应的uniqId
-func (n *NetBus) TopicUniqIdList(topics []string) *ret.TopicUniqIdListRet {
-	res := ret.TopicUniqIdListRet{Data: make(map[string]*netsvrProtocol.TopicUniqIdListResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_TopicUniqIdList, &netsvrProtocol.TopicUniqIdListReq{Topics: topics})
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::TopicUniqIdList failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		topicUniqIdListResp := &netsvrProtocol.TopicUniqIdListResp{}
-		if err := proto.Unmarshal(respData[4:], topicUniqIdListResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.TopicUniqIdListResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = topicUniqIdListResp
-	}
-	return &res
+func (n *NetBus) TopicUniqIdList(ctx context.Context, topics []string) (*ret.TopicUniqIdListRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.TopicUniqIdListResp](ctx, n, netsvrProtocol.Cmd_TopicUniqIdList, &netsvrProtocol.TopicUniqIdListReq{Topics: topics})
+	return &ret.TopicUniqIdListRet{Gateways: gateways, Data: data}, err
 }
 
 // TopicUniqIdCount 获取所有网关中存储的topic对应的uniqId数量
-func (n *NetBus) TopicUniqIdCount(topics []string, allTopic bool) *ret.TopicUniqIdCountRet {
-	res := ret.TopicUniqIdCountRet{Data: make(map[string]*netsvrProtocol.TopicUniqIdCountResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_TopicUniqIdCount, &netsvrProtocol.TopicUniqIdCountReq{
+func (n *NetBus) TopicUniqIdCount(ctx context.Context, topics []string, allTopic bool) (*ret.TopicUniqIdCountRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.TopicUniqIdCountResp](ctx, n, netsvrProtocol.Cmd_TopicUniqIdCount, &netsvrProtocol.TopicUniqIdCountReq{
 		Topics:   topics,
 		CountAll: allTopic,
 	})
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::TopicUniqIdCount failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		topicUniqIdCountResp := &netsvrProtocol.TopicUniqIdCountResp{}
-		if err := proto.Unmarshal(respData[4:], topicUniqIdCountResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.TopicUniqIdCountResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = topicUniqIdCountResp
-	}
-	return &res
+	return &ret.TopicUniqIdCountRet{Gateways: gateways, Data: data}, err
 }
 
 // TopicCustomerIdList 获取所有网关中存储的topic对应的customerId
-func (n *NetBus) TopicCustomerIdList(topics []string) *ret.TopicCustomerIdListRet {
-	res := ret.TopicCustomerIdListRet{Data: make(map[string]*netsvrProtocol.TopicCustomerIdListResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_TopicCustomerIdList, &netsvrProtocol.TopicCustomerIdListReq{Topics: topics})
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::TopicCustomerIdList failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		topicCustomerIdListResp := &netsvrProtocol.TopicCustomerIdListResp{}
-		if err := proto.Unmarshal(respData[4:], topicCustomerIdListResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.TopicCustomerIdListResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = topicCustomerIdListResp
-	}
-	return &res
+func (n *NetBus) TopicCustomerIdList(ctx context.Context, topics []string) (*ret.TopicCustomerIdListRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.TopicCustomerIdListResp](ctx, n, netsvrProtocol.Cmd_TopicCustomerIdList, &netsvrProtocol.TopicCustomerIdListReq{Topics: topics})
+	return &ret.TopicCustomerIdListRet{Gateways: gateways, Data: data}, err
 }
 
 // TopicCustomerIdToUniqIdsList 获取所有网关中存储的topic对应的customerId对应的uniqId
-func (n *NetBus) TopicCustomerIdToUniqIdsList(topics []string) *ret.TopicCustomerIdToUniqIdsListRet {
-	res := ret.TopicCustomerIdToUniqIdsListRet{Data: make(map[string]*netsvrProtocol.TopicCustomerIdToUniqIdsListResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_TopicCustomerIdToUniqIdsList, &netsvrProtocol.TopicCustomerIdToUniqIdsListReq{Topics: topics})
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::TopicCustomerIdToUniqIdsList failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		topicCustomerIdToUniqIdsListResp := &netsvrProtocol.TopicCustomerIdToUniqIdsListResp{}
-		if err := proto.Unmarshal(respData[4:], topicCustomerIdToUniqIdsListResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.TopicCustomerIdToUniqIdsListResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = topicCustomerIdToUniqIdsListResp
-	}
-	return &res
+func (n *NetBus) TopicCustomerIdToUniqIdsList(ctx context.Context, topics []string) (*ret.TopicCustomerIdToUniqIdsListRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.TopicCustomerIdToUniqIdsListResp](ctx, n, netsvrProtocol.Cmd_TopicCustomerIdToUniqIdsList, &netsvrProtocol.TopicCustomerIdToUniqIdsListReq{Topics: topics})
+	return &ret.TopicCustomerIdToUniqIdsListRet{Gateways: gateways, Data: data}, err
 }
 
 // TopicCustomerIdCount 获取所有网关中存储的topic对应的customerId数量
-func (n *NetBus) TopicCustomerIdCount(topics []string, allTopic bool) *ret.TopicCustomerIdCountRet {
-	res := ret.TopicCustomerIdCountRet{Data: make(map[string]*netsvrProtocol.TopicCustomerIdCountResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_TopicCustomerIdCount, &netsvrProtocol.TopicCustomerIdCountReq{
+func (n *NetBus) TopicCustomerIdCount(ctx context.Context, topics []string, allTopic bool) (*ret.TopicCustomerIdCountRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.TopicCustomerIdCountResp](ctx, n, netsvrProtocol.Cmd_TopicCustomerIdCount, &netsvrProtocol.TopicCustomerIdCountReq{
 		Topics:   topics,
 		CountAll: allTopic,
 	})
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::TopicCustomerIdCount failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		topicCustomerIdCountResp := &netsvrProtocol.TopicCustomerIdCountResp{}
-		if err := proto.Unmarshal(respData[4:], topicCustomerIdCountResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.TopicCustomerIdCountResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = topicCustomerIdCountResp
-	}
-	return &res
+	return &ret.TopicCustomerIdCountRet{Gateways: gateways, Data: data}, err
 }
 
 // ConnInfo 获取所有网关中存储的连接信息
-func (n *NetBus) ConnInfo(uniqIds []string, reqCustomerId bool, reqSession bool, reqTopic bool) *ret.ConnInfoRet {
-	res := ret.ConnInfoRet{Data: make(map[string]*netsvrProtocol.ConnInfoResp)}
-	if n.isSinglePoint() || len(uniqIds) == 1 {
-		socket := n.getTaskSocketByUniqId(uniqIds[0])
-		if socket == nil {
-			return &res
-		}
-		defer socket.Release()
-		connInfoReq := netsvrProtocol.ConnInfoReq{
-			UniqIds:       uniqIds,
-			ReqCustomerId: reqCustomerId,
-			ReqSession:    reqSession,
-			ReqTopic:      reqTopic,
-		}
-		socket.Send(n.pack(netsvrProtocol.Cmd_ConnInfo, &connInfoReq))
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::ConnInfo failed because the connection to the netsvr was disconnected")
-			return &res
-		}
-		connInfoResp := &netsvrProtocol.ConnInfoResp{}
-		if err := proto.Unmarshal(respData[4:], connInfoResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.ConnInfoResp failed", "error", err)
-			return &res
-		}
-		res.Data[socket.GetAddr()] = connInfoResp
-		return &res
-	}
-	group := n.getUniqIdsGroupByAddrAsHex(uniqIds)
-	fn := func(socket *taskSocket.TaskSocket, currentUniqIds []string) {
-		defer socket.Release()
-		connInfoReq := netsvrProtocol.ConnInfoReq{
+func (n *NetBus) ConnInfo(ctx context.Context, uniqIds []string, reqCustomerId bool, reqSession bool, reqTopic bool) (*ret.ConnInfoRet, error) {
+	group, routeErr := n.routeUniqIds(uniqIds)
+	reqs := make(map[string]proto.Message, len(group))
+	for addrAsHex, currentUniqIds := range group {
+		reqs[addrAsHex] = &netsvrProtocol.ConnInfoReq{
 			UniqIds:       currentUniqIds,
 			ReqCustomerId: reqCustomerId,
 			ReqSession:    reqSession,
 			ReqTopic:      reqTopic,
 		}
-		socket.Send(n.pack(netsvrProtocol.Cmd_ConnInfo, &connInfoReq))
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::ConnInfo failed because the connection to the netsvr was disconnected")
-			return
-		}
-		connInfoResp := &netsvrProtocol.ConnInfoResp{}
-		if err := proto.Unmarshal(respData[4:], connInfoResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.ConnInfoResp failed", "error", err)
-			return
-		}
-		res.Data[socket.GetAddr()] = connInfoResp
 	}
-	for addrAsHex, currentUniqIds := range group {
-		socket := n.taskSocketPoolManger.GetSocket(addrAsHex)
-		if socket == nil {
-			continue
-		}
-		fn(socket, currentUniqIds)
-	}
-	return &res
+	data, gateways, err := queryGroup[netsvrProtocol.ConnInfoResp](ctx, n, netsvrProtocol.Cmd_ConnInfo, reqs, groupAddrs(group))
+	return &ret.ConnInfoRet{Gateways: gateways, Data: data}, errors.Join(routeErr, err)
 }
 
 // ConnInfoByCustomerId 根据customerId获取所有网关中存储的连接信息
-func (n *NetBus) ConnInfoByCustomerId(customerIds []string, reqUniqId bool, reqSession bool, reqTopic bool) *ret.ConnInfoByCustomerIdRet {
-	res := ret.ConnInfoByCustomerIdRet{Data: make(map[string]*netsvrProtocol.ConnInfoByCustomerIdResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_ConnInfoByCustomerId, &netsvrProtocol.ConnInfoByCustomerIdReq{
+func (n *NetBus) ConnInfoByCustomerId(ctx context.Context, customerIds []string, reqUniqId bool, reqSession bool, reqTopic bool) (*ret.ConnInfoByCustomerIdRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.ConnInfoByCustomerIdResp](ctx, n, netsvrProtocol.Cmd_ConnInfoByCustomerId, &netsvrProtocol.ConnInfoByCustomerIdReq{
 		CustomerIds: customerIds,
 		ReqUniqId:   reqUniqId,
 		ReqSession:  reqSession,
 		ReqTopic:    reqTopic,
 	})
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::ConnInfoByCustomerId failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		connInfoByCustomerIdResp := &netsvrProtocol.ConnInfoByCustomerIdResp{}
-		if err := proto.Unmarshal(respData[4:], connInfoByCustomerIdResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.ConnInfoByCustomerIdResp failed", "error", err)
-			continue
-		}
-		res.Data[socket.GetAddr()] = connInfoByCustomerIdResp
-	}
-	return &res
+	return &ret.ConnInfoByCustomerIdRet{Gateways: gateways, Data: data}, err
 }
 
 // Metrics 获取所有网关的统计信息
-func (n *NetBus) Metrics() *ret.MetricsRet {
-	res := ret.MetricsRet{Data: make(map[string]*netsvrProtocol.MetricsResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_Metrics, nil)
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::Metrics failed because the connection to the netsvr was disconnected")
+func (n *NetBus) Metrics(ctx context.Context) (*ret.MetricsRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.MetricsResp](ctx, n, netsvrProtocol.Cmd_Metrics, nil)
+	return &ret.MetricsRet{Gateways: gateways, Data: data}, err
+}
+
+// Limit 设置或读取网关针对business的每秒转发数量的限制的配置，addr为空则作用于所有网关
+func (n *NetBus) Limit(ctx context.Context, limitReq *netsvrProtocol.LimitReq, addr string) (*ret.LimitRet, error) {
+	if addr == "" {
+		data, gateways, err := queryAll[netsvrProtocol.LimitResp](ctx, n, netsvrProtocol.Cmd_Limit, limitReq)
+		return &ret.LimitRet{Gateways: gateways, Data: data}, err
+	}
+	addrAsHex := n.taskSocketPoolManger.AddrAsHex(addr)
+	reqs := map[string]proto.Message{addrAsHex: limitReq}
+	data, gateways, err := queryGroup[netsvrProtocol.LimitResp](ctx, n, netsvrProtocol.Cmd_Limit, reqs, map[string]string{addrAsHex: addr})
+	return &ret.LimitRet{Gateways: gateways, Data: data}, err
+}
+
+// CustomerIdList 获取所有网关的customerId列表
+func (n *NetBus) CustomerIdList(ctx context.Context) (*ret.CustomerIdListRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.CustomerIdListResp](ctx, n, netsvrProtocol.Cmd_CustomerIdList, nil)
+	return &ret.CustomerIdListRet{Gateways: gateways, Data: data}, err
+}
+
+// CustomerIdCount 统计网关的在线客户数，注意各个网关的客户数之和不一定等于总在线客户数，因为可能一个客户有多个设备连接到不同网关
+func (n *NetBus) CustomerIdCount(ctx context.Context) (*ret.CustomerIdCountRet, error) {
+	data, gateways, err := queryAll[netsvrProtocol.CustomerIdCountResp](ctx, n, netsvrProtocol.Cmd_CustomerIdCount, nil)
+	return &ret.CustomerIdCountRet{Gateways: gateways, Data: data}, err
+}
+
+// Flush 等待所有网关的异步写入器把已经入队的数据写入，返回上一次Flush以来的写入错误，没有开启异步发送时直接返回nil
+// 写入器已经关闭的网关返回*contract.GatewayError，之前入队的数据不一定写入了
+func (n *NetBus) Flush(ctx context.Context) error {
+	if !n.asyncSend {
+		return nil
+	}
+	var errs []error
+	for _, addrAsHex := range n.taskSocketPoolManger.GetAddrsAsHex() {
+		writer, err := n.taskSocketPoolManger.GetAsyncWriter(addrAsHex)
+		if err != nil || writer == nil {
 			continue
 		}
-		metricsResp := &netsvrProtocol.MetricsResp{}
-		if err := proto.Unmarshal(respData[4:], metricsResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.MetricsResp failed", "error", err)
-			continue
+		if err = writer.Flush(ctx); errors.Is(err, contract.ErrPoolClosed) {
+			errs = append(errs, &contract.GatewayError{Addr: writer.GetAddr(), Err: err})
+		} else if err != nil {
+			errs = append(errs, err)
 		}
-		res.Data[socket.GetAddr()] = metricsResp
 	}
-	return &res
+	return errors.Join(errs...)
 }
 
-// Limit 设置或读取网关针对business的每秒转发数量的限制的配置
-func (n *NetBus) Limit(limitReq *netsvrProtocol.LimitReq, addr string) *ret.LimitRet {
-	res := ret.LimitRet{Data: make(map[string]*netsvrProtocol.LimitResp)}
+// sendToSockets 给所有网关发送数据，部分可用模式下，会跳过不可用的网关，key是有序模式下选择有序通道的依据
+func (n *NetBus) sendToSockets(ctx context.Context, key string, message *socket.Frame) error {
+	if n.asyncSend {
+		if writers := n.taskSocketPoolManger.GetAsyncWriters(); writers != nil {
+			return n.writeToAsyncWriters(ctx, writers, message)
+		}
+	}
+	if n.partialAvailability {
+		return n.sendToAvailableSockets(ctx, key, message)
+	}
 	var taskSockets []*taskSocket.TaskSocket
-	if addr == "" {
-		taskSockets = n.taskSocketPoolManger.GetSockets()
+	var err error
+	if n.orderedDelivery {
+		taskSockets, err = n.taskSocketPoolManger.GetPinnedSocketsContext(ctx, key)
 	} else {
-		addrAsHex := contract.AddrConvertToHex(addr)
-		socket := n.taskSocketPoolManger.GetSocket(addrAsHex)
-		if socket == nil {
-			return nil
-		}
-		taskSockets = []*taskSocket.TaskSocket{socket}
+		taskSockets, err = n.taskSocketPoolManger.GetSocketsContext(ctx)
+	}
+	if err != nil {
+		return err
 	}
 	defer func() {
 		for _, socket := range taskSockets {
 			socket.Release()
 		}
 	}()
-	message := n.pack(netsvrProtocol.Cmd_Limit, limitReq)
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::Limit failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		limitResp := &netsvrProtocol.LimitResp{}
-		if err := proto.Unmarshal(respData[4:], limitResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.LimitResp failed", "error", err)
-			continue
+	var errs []error
+	for _, taskSocket := range taskSockets {
+		if err = taskSocket.SendFrameContext(ctx, message); err != nil {
+			errs = append(errs, &contract.GatewayError{Addr: taskSocket.GetAddr(), Err: err})
 		}
-		res.Data[socket.GetAddr()] = limitResp
 	}
-	return &res
+	return errors.Join(errs...)
 }
 
-// CustomerIdList 获取所有网关的customerId列表
-func (n *NetBus) CustomerIdList() *ret.CustomerIdListRet {
-	res := ret.CustomerIdListRet{Data: make(map[string]*netsvrProtocol.CustomerIdListResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
+// sendToAvailableSockets 给所有可用的网关发送数据，获取socket失败以及发送失败的网关通过*contract.PartialError返回
+func (n *NetBus) sendToAvailableSockets(ctx context.Context, key string, message *socket.Frame) error {
+	var taskSockets []*taskSocket.TaskSocket
+	var err error
+	if n.orderedDelivery {
+		taskSockets, err = n.taskSocketPoolManger.GetAvailablePinnedSocketsContext(ctx, key)
+	} else {
+		taskSockets, err = n.taskSocketPoolManger.GetAvailableSocketsContext(ctx)
+	}
 	defer func() {
 		for _, socket := range taskSockets {
 			socket.Release()
 		}
 	}()
-	message := n.pack(netsvrProtocol.Cmd_CustomerIdList, nil)
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::CustomerIdList failed because the connection to the netsvr was disconnected")
-			continue
-		}
-		customerIdListResp := &netsvrProtocol.CustomerIdListResp{}
-		if err := proto.Unmarshal(respData[4:], customerIdListResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.CustomerIdListResp failed", "error", err)
-			continue
+	partialErr := &contract.PartialError{}
+	if err != nil && !errors.As(err, &partialErr) {
+		return err
+	}
+	for _, taskSocket := range taskSockets {
+		if err = taskSocket.SendFrameContext(ctx, message); err != nil {
+			partialErr.Skipped = append(partialErr.Skipped, &contract.GatewayError{Addr: taskSocket.GetAddr(), Err: err})
 		}
-		res.Data[socket.GetAddr()] = customerIdListResp
 	}
-	return &res
+	if len(partialErr.Skipped) > 0 {
+		return partialErr
+	}
+	return nil
 }
 
-// CustomerIdCount 统计网关的在线客户数，注意各个网关的客户数之和不一定等于总在线客户数，因为可能一个客户有多个设备连接到不同网关
-func (n *NetBus) CustomerIdCount() *ret.CustomerIdCountRet {
-	res := ret.CustomerIdCountRet{Data: make(map[string]*netsvrProtocol.CustomerIdCountResp)}
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
+// sendToSocketByUniqId 给uniqId所在的网关发送数据，uniqId无法路由时返回*contract.UniqIdError
+func (n *NetBus) sendToSocketByUniqId(ctx context.Context, uniqId string, message *socket.Frame) error {
+	failures := routeFailures{}
+	addrAsHex := n.routeUniqId(uniqId, &failures)
+	if addrAsHex == "" {
+		return failures.err()
+	}
+	return n.sendToSocketByAddrAsHex(ctx, addrAsHex, uniqId, message)
+}
+
+// writeToAsyncWriters 把数据放入所有网关的异步写入器，部分可用模式下，入队失败的网关通过*contract.PartialError返回
+// 写入器已经关闭同样是入队失败，与同步发送一致
+func (n *NetBus) writeToAsyncWriters(ctx context.Context, writers []*taskSocket.AsyncWriter, message *socket.Frame) error {
+	var skipped []*contract.GatewayError
+	for _, writer := range writers {
+		if err := writer.WriteFrame(ctx, message.Retain()); err != nil {
+			skipped = append(skipped, &contract.GatewayError{Addr: writer.GetAddr(), Err: err})
 		}
-	}()
-	message := n.pack(netsvrProtocol.Cmd_CustomerIdCount, nil)
-	for _, socket := range taskSockets {
-		socket.Send(message)
-		respData := socket.Receive()
-		if respData == nil {
-			log.Error("call Cmd::CustomerIdCount failed because the connection to the netsvr was disconnected")
-			continue
+	}
+	if len(skipped) == 0 {
+		return nil
+	}
+	if n.partialAvailability {
+		return &contract.PartialError{Skipped: skipped}
+	}
+	errs := make([]error, 0, len(skipped))
+	for _, v := range skipped {
+		errs = append(errs, v)
+	}
+	return errors.Join(errs...)
+}
+
+func (n *NetBus) sendToSocketByAddrAsHex(ctx context.Context, addrAsHex string, key string, message *socket.Frame) error {
+	if n.asyncSend {
+		writer, err := n.taskSocketPoolManger.GetAsyncWriter(addrAsHex)
+		if err != nil {
+			return err
 		}
-		customerIdCountResp := &netsvrProtocol.CustomerIdCountResp{}
-		if err := proto.Unmarshal(respData[4:], customerIdCountResp); err != nil {
-			log.Error("unmarshal netsvrProtocol.CustomerIdCountResp failed", "error", err)
-			continue
+		if writer != nil {
+			if err = writer.WriteFrame(ctx, message.Retain()); err != nil {
+				return &contract.GatewayError{Addr: writer.GetAddr(), Err: err}
+			}
+			return nil
 		}
-		res.Data[socket.GetAddr()] = customerIdCountResp
 	}
-	return &res
+	var taskSocket *taskSocket.TaskSocket
+	var err error
+	if n.orderedDelivery {
+		taskSocket, err = n.taskSocketPoolManger.GetPinnedSocketContext(ctx, addrAsHex, key)
+	} else {
+		taskSocket, err = n.taskSocketPoolManger.GetSocketContext(ctx, addrAsHex)
+	}
+	if err != nil {
+		return err
+	}
+	defer taskSocket.Release()
+	if err = taskSocket.SendFrameContext(ctx, message); err != nil {
+		return &contract.GatewayError{Addr: taskSocket.GetAddr(), Err: err}
+	}
+	return nil
 }
 
-func (n *NetBus) sendToSockets(data []byte) {
-	taskSockets := n.taskSocketPoolManger.GetSockets()
-	defer func() {
-		for _, socket := range taskSockets {
-			socket.Release()
-		}
-	}()
-	for _, socket := range taskSockets {
-		socket.Send(data)
+// call 向网关发送请求，并将网关的响应解码到resp中
+func (n *NetBus) call(ctx context.Context, taskSocket *taskSocket.TaskSocket, message *socket.Frame, resp proto.Message) error {
+	respFrame := socket.AcquireFrame()
+	defer respFrame.Release()
+	if err := taskSocket.RoundTripContext(ctx, message, respFrame); err != nil {
+		return &contract.GatewayError{Addr: taskSocket.GetAddr(), Err: err}
+	}
+	//响应的前4个字节是cmd，proto.Unmarshal会拷贝数据，respFrame可以放心的归还
+	respData := respFrame.Payload()
+	if len(respData) < 4 {
+		return &contract.GatewayError{Addr: taskSocket.GetAddr(), Err: fmt.Errorf("%w: response too short", contract.ErrDecode)}
+	}
+	if err := proto.Unmarshal(respData[4:], resp); err != nil {
+		return &contract.GatewayError{Addr: taskSocket.GetAddr(), Err: fmt.Errorf("%w: unmarshal %T: %w", contract.ErrDecode, resp, err)}
 	}
+	return nil
 }
 
-func (n *NetBus) sendToSocketByUniqId(uniqId string, data []byte) {
-	socket := n.taskSocketPoolManger.GetSocket(contract.UniqIdConvertToAddrAsHex(uniqId))
-	if socket != nil {
-		defer socket.Release()
-		socket.Send(data)
+// fanOut 并发的对每个网关执行fn，并发数受concurrency限制，所有fn执行完毕后才返回
+func (n *NetBus) fanOut(addrsAsHex []string, fn func(addrAsHex string)) {
+	if len(addrsAsHex) == 1 {
+		fn(addrsAsHex[0])
 		return
 	}
+	var sem chan struct{}
+	if n.concurrency > 0 {
+		sem = make(chan struct{}, n.concurrency)
+	}
+	wg := sync.WaitGroup{}
+	for _, addrAsHex := range addrsAsHex {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				if sem != nil {
+					<-sem
+				}
+				wg.Done()
+			}()
+			fn(addrAsHex)
+		}()
+	}
+	wg.Wait()
 }
 
-func (n *NetBus) sendToSocketByAddrAsHex(addrAsHex string, data []byte) {
-	socket := n.taskSocketPoolManger.GetSocket(addrAsHex)
-	if socket != nil {
-		defer socket.Release()
-		socket.Send(data)
+// routeUniqIds 将uniqId按所在网关分组，返回每个addrAsHex对应的uniqId列表
+// 格式不正确或者所在网关没有配置的uniqId会被剔除，并通过*contract.UniqIdError返回
+func (n *NetBus) routeUniqIds(uniqIds []string) (map[string][]string, error) {
+	if len(uniqIds) == 0 {
+		return nil, nil
 	}
+	res := make(map[string][]string)
+	failures := routeFailures{}
+	for _, uniqId := range uniqIds {
+		if addrAsHex := n.routeUniqId(uniqId, &failures); addrAsHex != "" {
+			res[addrAsHex] = append(res[addrAsHex], uniqId)
+		}
+	}
+	return res, failures.err()
 }
 
-func (n *NetBus) getTaskSocketByUniqId(uniqId string) *taskSocket.TaskSocket {
-	return n.taskSocketPoolManger.GetSocket(contract.UniqIdConvertToAddrAsHex(uniqId))
+// routeUniqId 返回uniqId所在网关的addrAsHex，格式不正确或者所在网关没有配置时，记录到failures并返回空字符串
+func (n *NetBus) routeUniqId(uniqId string, failures *routeFailures) string {
+	addrAsHex := contract.UniqIdConvertToAddrAsHex(uniqId)
+	if addrAsHex == "" {
+		failures.invalid = append(failures.invalid, uniqId)
+		return ""
+	}
+	if !n.taskSocketPoolManger.HasGateway(addrAsHex) {
+		failures.unknown = append(failures.unknown, uniqId)
+		return ""
+	}
+	return addrAsHex
 }
 
-func (n *NetBus) isSinglePoint() bool {
-	return n.taskSocketPoolManger.Count() == 1
+// routeFailures 按uniqId路由时失败的uniqId
+type routeFailures struct {
+	invalid []string
+	unknown []string
 }
 
-// getUniqIdsGroupByAddrAsHex 根据uniqId列表分组，返回每个addrAsHex对应的uniqId列表
-func (n *NetBus) getUniqIdsGroupByAddrAsHex(uniqIds []string) map[string][]string {
-	res := make(map[string][]string)
-	for _, uniqId := range uniqIds {
-		addrAsHex := contract.UniqIdConvertToAddrAsHex(uniqId)
-		res[addrAsHex] = append(res[addrAsHex], uniqId)
+// err 没有失败的uniqId时返回nil，否则返回*contract.UniqIdError
+func (f *routeFailures) err() error {
+	if len(f.invalid) == 0 && len(f.unknown) == 0 {
+		return nil
+	}
+	return &contract.UniqIdError{Invalid: f.invalid, Unknown: f.unknown}
+}
+
+// groupAddrs 从每组的第一个uniqId中取出网关地址，作为queryGroup的fallback
+func groupAddrs(group map[string][]string) map[string]string {
+	ret := make(map[string]string, len(group))
+	for addrAsHex, uniqIds := range group {
+		if uniqId, err := contract.ParseUniqId(uniqIds[0]); err == nil {
+			ret[addrAsHex] = uniqId.Addr()
+		}
 	}
-	return res
+	return ret
 }
 
-func (n *NetBus) pack(cmd netsvrProtocol.Cmd, req proto.Message) []byte {
-	data := make([]byte, 4)
-	binary.BigEndian.PutUint32(data[0:4], uint32(cmd))
+// pack 把cmd与请求编码到一个从池中获取的数据帧，调用方用完后需要Release
+func (n *NetBus) pack(cmd netsvrProtocol.Cmd, req proto.Message) (*socket.Frame, error) {
+	message := socket.AcquireFrame()
+	message.AppendUint32(uint32(cmd))
 	if req == nil {
-		return data
+		return message, nil
 	}
-	var err error
-	data, err = (proto.MarshalOptions{}).MarshalAppend(data, req)
+	if err := message.AppendProto(req); err != nil {
+		message.Release()
+		return nil, fmt.Errorf("%w: marshal %T: %w", contract.ErrEncode, req, err)
+	}
+	return message, nil
+}
+
+// orderKey 指令只针对一个uniqId或customerId时返回它，否则返回空字符串
+func orderKey(ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			return ""
+		}
+	}
+	return ids[0]
+}
+
+// queryAll 向所有网关发送同一个请求，返回以网关地址为key的响应，以及每个网关的请求情况
+func queryAll[T any, PT interface {
+	*T
+	proto.Message
+}](ctx context.Context, n *NetBus, cmd netsvrProtocol.Cmd, req proto.Message) (map[string]PT, ret.Gateways, error) {
+	message, err := n.pack(cmd, req)
 	if err != nil {
-		log.Error(fmt.Sprintf("Proto marshal %T failed", req), "error", err)
-		return nil
+		return make(map[string]PT), make(ret.Gateways), err
+	}
+	defer message.Release()
+	addrs := n.taskSocketPoolManger.GetAddrs()
+	messages := make(map[string]*socket.Frame, len(addrs))
+	for addrAsHex := range addrs {
+		messages[addrAsHex] = message
+	}
+	return queryEach[T, PT](ctx, n, messages, addrs)
+}
+
+// queryGroup 向多个网关发送各自的请求，reqs的key是网关地址的16进制字符串，返回以网关地址为key的响应，以及每个网关的请求情况
+// 网关地址取自添加网关时的地址，请求期间被移除的网关使用fallback中的地址
+func queryGroup[T any, PT interface {
+	*T
+	proto.Message
+}](ctx context.Context, n *NetBus, cmd netsvrProtocol.Cmd, reqs map[string]proto.Message, fallback map[string]string) (map[string]PT, ret.Gateways, error) {
+	messages := make(map[string]*socket.Frame, len(reqs))
+	defer func() {
+		for _, message := range messages {
+			message.Release()
+		}
+	}()
+	for addrAsHex, req := range reqs {
+		message, err := n.pack(cmd, req)
+		if err != nil {
+			return make(map[string]PT), make(ret.Gateways), err
+		}
+		messages[addrAsHex] = message
+	}
+	snapshot := n.taskSocketPoolManger.GetAddrs()
+	addrs := make(map[string]string, len(reqs))
+	for addrAsHex := range reqs {
+		if addr, ok := snapshot[addrAsHex]; ok {
+			addrs[addrAsHex] = addr
+		} else {
+			addrs[addrAsHex] = fallback[addrAsHex]
+		}
+	}
+	return queryEach[T, PT](ctx, n, messages, addrs)
+}
+
+// queryEach 并发的向messages中的每个网关发送对应的请求，并记录每个网关的耗时与错误，部分网关失败时，返回成功的部分以及失败的错误
+// addrs是网关地址的16进制字符串到网关地址的映射，返回结果以网关地址为key
+func queryEach[T any, PT interface {
+	*T
+	proto.Message
+}](ctx context.Context, n *NetBus, messages map[string]*socket.Frame, addrs map[string]string) (map[string]PT, ret.Gateways, error) {
+	data := make(map[string]PT, len(messages))
+	gateways := make(ret.Gateways, len(messages))
+	addrsAsHex := make([]string, 0, len(messages))
+	for addrAsHex := range messages {
+		addrsAsHex = append(addrsAsHex, addrAsHex)
+	}
+	mux := sync.Mutex{}
+	n.fanOut(addrsAsHex, func(addrAsHex string) {
+		start := time.Now()
+		addr := addrs[addrAsHex]
+		if addr == "" {
+			addr = addrAsHex
+		}
+		resp, err := queryOne[T, PT](ctx, n, addrAsHex, messages[addrAsHex])
+		latency := time.Since(start)
+		mux.Lock()
+		defer mux.Unlock()
+		gateways[addr] = &ret.Gateway{Addr: addr, Latency: latency, Err: err}
+		if err == nil {
+			data[addr] = resp
+		}
+	})
+	return data, gateways, gateways.Err()
+}
+
+// queryOne 向一个网关发送请求，返回网关的响应
+func queryOne[T any, PT interface {
+	*T
+	proto.Message
+}](ctx context.Context, n *NetBus, addrAsHex string, message *socket.Frame) (PT, error) {
+	socket, err := n.taskSocketPoolManger.GetSocketContext(ctx, addrAsHex)
+	if err != nil {
+		return nil, err
+	}
+	defer socket.Release()
+	resp := PT(new(T))
+	if err = n.call(ctx, socket, message, resp); err != nil {
+		return nil, err
 	}
-	return data
+	return resp, nil
 }
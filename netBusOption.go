@@ -0,0 +1,56 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package netsvrBusiness
+
+// Option NetBus的可选配置
+type Option func(n *NetBus)
+
+// WithConcurrency 设置向多个网关请求时的最大并发数，小于等于0表示不限制，默认不限制
+func WithConcurrency(concurrency int) Option {
+	return func(n *NetBus) {
+		n.concurrency = concurrency
+	}
+}
+
+// WithPartialAvailability 开启部分可用模式，默认关闭
+// 关闭时，Broadcast、TopicPublish等需要发给所有网关的指令，只要有一个网关不可用，就不会发给任何网关
+// 开启后，这些指令会跳过不可用的网关，继续发给其余网关，被跳过的网关通过*contract.PartialError返回
+func WithPartialAvailability() Option {
+	return func(n *NetBus) {
+		n.partialAvailability = true
+	}
+}
+
+// WithOrderedDelivery 开启有序投递，默认关闭
+// 开启后，单向指令不再从池中随机借用socket，而是按uniqId或customerId写入网关的有序通道，同一个key的指令总是经过同一个连接，网关会按发送的顺序处理
+// 有序通道的数量由taskSocket.WithLanes设置，默认每个网关只有一个通道，此时发往同一个网关的所有单向指令都是有序的
+// 通道数量大于1时，只有针对同一个uniqId或customerId的指令之间保证顺序，Broadcast、TopicPublish等指令不保证与它们的顺序
+func WithOrderedDelivery() Option {
+	return func(n *NetBus) {
+		n.orderedDelivery = true
+	}
+}
+
+// WithAsyncSend 开启异步发送，默认关闭
+// 开启后，单向指令会放入网关的异步写入器的队列后立即返回，由写入器合并成一次writev写入，写入失败通过taskSocket.AsyncWriterConfig.OnError与NetBus.Flush报告
+// 网关的池需要通过taskSocket.WithAsyncWriter配置异步写入器，没有配置的网关仍然同步发送
+// 每个网关的异步写入器只有一个连接，发往同一个网关的指令总是有序的，因此开启后WithOrderedDelivery对单向指令不再生效
+func WithAsyncSend() Option {
+	return func(n *NetBus) {
+		n.asyncSend = true
+	}
+}
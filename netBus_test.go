@@ -0,0 +1,442 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package netsvrBusiness
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
+	"github.com/buexplain/netsvr-business-go/v2/taskSocket"
+	"github.com/buexplain/netsvr-protocol-go/v6/netsvrProtocol"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway 模拟网关的task服务器，单向指令只记录，请求指令返回空响应，Cmd_UniqIdCount返回uniqIdCount
+type fakeGateway struct {
+	ln          net.Listener
+	uniqIdCount int32
+	//响应请求前的延迟
+	delay    time.Duration
+	mux      sync.Mutex
+	received []netsvrProtocol.Cmd
+	//收到指令的连接的对端地址
+	peers map[netsvrProtocol.Cmd]map[string]struct{}
+	//按接收顺序记录的单播数据
+	singleCasts []string
+}
+
+func newFakeGateway(t testing.TB, uniqIdCount int32) *fakeGateway {
+	g := &fakeGateway{uniqIdCount: uniqIdCount, peers: make(map[netsvrProtocol.Cmd]map[string]struct{})}
+	g.ln = testHelper.Listen(t, g.serve)
+	return g
+}
+
+func (g *fakeGateway) addr() string {
+	return g.ln.Addr().String()
+}
+
+func (g *fakeGateway) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	for {
+		body, err := testHelper.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		if len(body) < 4 {
+			//心跳
+			continue
+		}
+		cmd := netsvrProtocol.Cmd(binary.BigEndian.Uint32(body[0:4]))
+		g.mux.Lock()
+		g.received = append(g.received, cmd)
+		if _, ok := g.peers[cmd]; !ok {
+			g.peers[cmd] = make(map[string]struct{})
+		}
+		g.peers[cmd][conn.RemoteAddr().String()] = struct{}{}
+		if cmd == netsvrProtocol.Cmd_SingleCast {
+			singleCast := &netsvrProtocol.SingleCast{}
+			_ = proto.Unmarshal(body[4:], singleCast)
+			g.singleCasts = append(g.singleCasts, string(singleCast.Data))
+		}
+		g.mux.Unlock()
+		if cmd < netsvrProtocol.Cmd_Register {
+			continue
+		}
+		time.Sleep(g.delay)
+		var resp proto.Message
+		if cmd == netsvrProtocol.Cmd_UniqIdCount {
+			resp = &netsvrProtocol.UniqIdCountResp{Count: g.uniqIdCount}
+		}
+		if err = testHelper.WriteCmd(conn, cmd, resp); err != nil {
+			return
+		}
+	}
+}
+
+func (g *fakeGateway) count(cmd netsvrProtocol.Cmd) int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	ret := 0
+	for _, v := range g.received {
+		if v == cmd {
+			ret++
+		}
+	}
+	return ret
+}
+
+// peerCount 返回发送过cmd的连接数
+func (g *fakeGateway) peerCount(cmd netsvrProtocol.Cmd) int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return len(g.peers[cmd])
+}
+
+// uniqId 构造一个属于该网关的uniqId
+func (g *fakeGateway) uniqId(seq uint32) string {
+	return contract.AddrConvertToHex(g.addr()) + fmt.Sprintf("%08x%08x", uint32(time.Now().Unix()), seq)
+}
+
+func newNetBusForTest(addrs []string, opts ...Option) *NetBus {
+	manger := taskSocket.NewManger()
+	for _, addr := range addrs {
+		factory := taskSocket.NewFactory(addr, time.Second, time.Second, time.Second)
+		manger.AddSocket(taskSocket.NewPool(2, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~")))
+	}
+	return NewNetBus(manger, opts...)
+}
+
+func TestNetBus_WithDialer_Routing(t *testing.T) {
+	gateway := newFakeGateway(t, 0)
+	//网关在uniqId中编码的地址与实际连接的地址不同，例如通过Unix域套接字或代理连接
+	addr := "10.0.0.1:6062"
+	manger := taskSocket.NewManger()
+	factory := taskSocket.NewFactory(addr, time.Second, time.Second, time.Second, socket.WithDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, "tcp", gateway.addr())
+	}))
+	manger.AddSocket(taskSocket.NewPool(1, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~")))
+	netBus := NewNetBus(manger)
+	defer netBus.Close()
+	uniqId := contract.AddrConvertToHex(addr) + "0000000000000001"
+	if err := netBus.SingleCast(context.Background(), uniqId, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if gateway.count(netsvrProtocol.Cmd_SingleCast) != 1 {
+		t.Error("SingleCast should be routed through the dialer")
+	}
+}
+
+func TestNetBus_UniqIdCount_Partial(t *testing.T) {
+	gateway := newFakeGateway(t, 3)
+	dead := testHelper.DeadAddr(t)
+	netBus := newNetBusForTest([]string{gateway.addr(), dead})
+	defer netBus.Close()
+	res, err := netBus.UniqIdCount(context.Background())
+	if !errors.Is(err, contract.ErrGatewayDisconnected) {
+		t.Error("UniqIdCount should return contract.ErrGatewayDisconnected", err)
+	}
+	if res.Complete() {
+		t.Error("UniqIdCount should not be complete")
+	}
+	failed := res.FailedGateways()
+	if len(failed) != 1 || failed[0] != dead {
+		t.Error("FailedGateways failed", failed)
+	}
+	if res.Count() != 3 || len(res.Gateways) != 2 {
+		t.Error("UniqIdCount failed", res.Count(), len(res.Gateways))
+	}
+}
+
+func TestNetBus_Limit_GatewayNotFound(t *testing.T) {
+	gateway := newFakeGateway(t, 0)
+	netBus := newNetBusForTest([]string{gateway.addr()})
+	defer netBus.Close()
+	unknown := "127.0.0.1:1"
+	res, err := netBus.Limit(context.Background(), &netsvrProtocol.LimitReq{}, unknown)
+	if !errors.Is(err, contract.ErrGatewayNotFound) {
+		t.Error("Limit should return contract.ErrGatewayNotFound", err)
+	}
+	failed := res.FailedGateways()
+	if len(failed) != 1 || failed[0] != unknown {
+		t.Error("FailedGateways failed", failed)
+	}
+}
+
+func TestNetBus_SingleCast_InvalidUniqId(t *testing.T) {
+	gateway := newFakeGateway(t, 0)
+	netBus := newNetBusForTest([]string{gateway.addr()})
+	defer netBus.Close()
+	if err := netBus.SingleCast(context.Background(), "invalid", []byte("hello")); !errors.Is(err, contract.ErrInvalidUniqId) {
+		t.Error("SingleCast should return contract.ErrInvalidUniqId", err)
+	}
+}
+
+func TestNetBus_Multicast_UniqIdError(t *testing.T) {
+	gateway := newFakeGateway(t, 0)
+	netBus := newNetBusForTest([]string{gateway.addr()})
+	defer netBus.Close()
+	unknown := contract.AddrConvertToHex("10.0.0.1:6062") + "0000000000000001"
+	err := netBus.Multicast(context.Background(), []string{gateway.uniqId(1), "invalid", unknown, gateway.uniqId(2)}, []byte("hello"))
+	var uniqIdErr *contract.UniqIdError
+	if !errors.As(err, &uniqIdErr) || !errors.Is(err, contract.ErrInvalidUniqId) || !errors.Is(err, contract.ErrGatewayNotFound) {
+		t.Fatal("Multicast should return *contract.UniqIdError", err)
+	}
+	if len(uniqIdErr.Invalid) != 1 || uniqIdErr.Invalid[0] != "invalid" || len(uniqIdErr.Unknown) != 1 || uniqIdErr.Unknown[0] != unknown {
+		t.Error("unexpected UniqIdError", uniqIdErr)
+	}
+	//其余的uniqId不受影响
+	time.Sleep(time.Millisecond * 100)
+	if gateway.count(netsvrProtocol.Cmd_Multicast) != 1 {
+		t.Error("Multicast should still reach the known gateway")
+	}
+	if err = netBus.SingleCast(context.Background(), unknown, []byte("hello")); !errors.As(err, &uniqIdErr) || !errors.Is(err, contract.ErrGatewayNotFound) {
+		t.Error("SingleCast should report the unknown gateway", err)
+	}
+	if err = netBus.SingleCastBulk(context.Background(), []string{unknown, "invalid"}, [][]byte{[]byte("a"), []byte("b")}); !errors.Is(err, contract.ErrInvalidUniqId) || !errors.Is(err, contract.ErrGatewayNotFound) {
+		t.Error("SingleCastBulk should report the invalid and unknown uniqIds", err)
+	}
+}
+
+func TestNetBus_UniqIdCount_Concurrency(t *testing.T) {
+	delay := time.Millisecond * 200
+	addrs := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		gateway := newFakeGateway(t, 1)
+		gateway.delay = delay
+		addrs = append(addrs, gateway.addr())
+	}
+	//不限制并发，耗时接近单个网关的耗时
+	netBus := newNetBusForTest(addrs)
+	defer netBus.Close()
+	start := time.Now()
+	res, err := netBus.UniqIdCount(context.Background())
+	if err != nil || res.Count() != 3 {
+		t.Fatal("UniqIdCount failed", err)
+	}
+	if time.Since(start) >= delay*2 {
+		t.Error("UniqIdCount should request gateways concurrently", time.Since(start))
+	}
+	//并发数为1，退化为逐个请求
+	serial := newNetBusForTest(addrs, WithConcurrency(1))
+	defer serial.Close()
+	start = time.Now()
+	res, err = serial.UniqIdCount(context.Background())
+	if err != nil || res.Count() != 3 {
+		t.Fatal("UniqIdCount failed", err)
+	}
+	if time.Since(start) < delay*3 {
+		t.Error("WithConcurrency(1) should request gateways one by one", time.Since(start))
+	}
+}
+
+func TestNetBus_Broadcast_PartialAvailability(t *testing.T) {
+	gateway := newFakeGateway(t, 0)
+	dead := testHelper.DeadAddr(t)
+	//默认模式下，只要有一个网关不可用，就不会发给任何网关
+	strict := newNetBusForTest([]string{gateway.addr(), dead})
+	defer strict.Close()
+	if err := strict.Broadcast(context.Background(), []byte("hello")); !errors.Is(err, contract.ErrGatewayDisconnected) {
+		t.Error("Broadcast should return contract.ErrGatewayDisconnected", err)
+	}
+	//部分可用模式下，跳过不可用的网关
+	partial := newNetBusForTest([]string{gateway.addr(), dead}, WithPartialAvailability())
+	defer partial.Close()
+	err := partial.Broadcast(context.Background(), []byte("hello"))
+	var partialErr *contract.PartialError
+	if !errors.As(err, &partialErr) || len(partialErr.Addrs()) != 1 || partialErr.Addrs()[0] != dead {
+		t.Error("Broadcast should report the skipped gateway", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if gateway.count(netsvrProtocol.Cmd_Broadcast) != 1 {
+		t.Error("Broadcast should be delivered to the healthy gateway only once")
+	}
+}
+
+func TestNetBus_SingleCast_OrderedDelivery(t *testing.T) {
+	gateway := newFakeGateway(t, 0)
+	netBus := newNetBusForTest([]string{gateway.addr()}, WithOrderedDelivery())
+	defer netBus.Close()
+	uniqId := gateway.uniqId(1)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := netBus.SingleCast(context.Background(), uniqId, []byte(fmt.Sprintf("%d:%02d", i, j))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(time.Millisecond * 100)
+	if gateway.peerCount(netsvrProtocol.Cmd_SingleCast) != 1 {
+		t.Error("SingleCast to the same uniqId should use the same connection", gateway.peerCount(netsvrProtocol.Cmd_SingleCast))
+	}
+	gateway.mux.Lock()
+	defer gateway.mux.Unlock()
+	if len(gateway.singleCasts) != 160 {
+		t.Fatal("SingleCast lost", len(gateway.singleCasts))
+	}
+	last := make(map[string]string)
+	for _, v := range gateway.singleCasts {
+		if last[v[0:1]] > v {
+			t.Error("SingleCast out of order", v)
+		}
+		last[v[0:1]] = v
+	}
+}
+
+func TestNetBus_SingleCast_AsyncSend(t *testing.T) {
+	gateway := newFakeGateway(t, 0)
+	manger := taskSocket.NewManger()
+	factory := taskSocket.NewFactory(gateway.addr(), time.Second, time.Second, time.Second)
+	manger.AddSocket(taskSocket.NewPool(2, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"), taskSocket.WithAsyncWriter(taskSocket.AsyncWriterConfig{})))
+	netBus := NewNetBus(manger, WithAsyncSend())
+	defer netBus.Close()
+	uniqId := gateway.uniqId(1)
+	for i := 0; i < 100; i++ {
+		if err := netBus.SingleCast(context.Background(), uniqId, []byte(fmt.Sprintf("%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := netBus.Broadcast(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := netBus.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if gateway.count(netsvrProtocol.Cmd_SingleCast) != 100 || gateway.count(netsvrProtocol.Cmd_Broadcast) != 1 {
+		t.Error("async send lost frames", gateway.count(netsvrProtocol.Cmd_SingleCast))
+	}
+	if gateway.peerCount(netsvrProtocol.Cmd_SingleCast) != 1 {
+		t.Error("async send should use the writer's connection only")
+	}
+	gateway.mux.Lock()
+	defer gateway.mux.Unlock()
+	for i, v := range gateway.singleCasts {
+		if v != fmt.Sprintf("%03d", i) {
+			t.Fatal("async send out of order", i, v)
+		}
+	}
+}
+
+func TestNetBus_AsyncSend_PoolClosed(t *testing.T) {
+	gateway := newFakeGateway(t, 0)
+	manger := taskSocket.NewManger()
+	factory := taskSocket.NewFactory(gateway.addr(), time.Second, time.Second, time.Second)
+	pool := taskSocket.NewPool(2, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"), taskSocket.WithAsyncWriter(taskSocket.AsyncWriterConfig{}))
+	manger.AddSocket(pool)
+	netBus := NewNetBus(manger, WithAsyncSend())
+	defer netBus.Close()
+	pool.Close()
+	//写入器已经关闭，数据没有入队，不能当作发送成功
+	if err := netBus.Broadcast(context.Background(), []byte("hello")); !errors.Is(err, contract.ErrPoolClosed) {
+		t.Error("Broadcast should return contract.ErrPoolClosed", err)
+	}
+	if err := netBus.SingleCast(context.Background(), gateway.uniqId(1), []byte("hello")); !errors.Is(err, contract.ErrPoolClosed) {
+		t.Error("SingleCast should return contract.ErrPoolClosed", err)
+	}
+	var gatewayErr *contract.GatewayError
+	if err := netBus.Flush(context.Background()); !errors.Is(err, contract.ErrPoolClosed) || !errors.As(err, &gatewayErr) || gatewayErr.Addr != gateway.addr() {
+		t.Error("Flush should return contract.ErrPoolClosed", err)
+	}
+}
+
+func BenchmarkNetBus_SingleCast(b *testing.B) {
+	addr := testHelper.ListenSilent(b).Addr().String()
+	netBus := newNetBusForTest([]string{addr})
+	defer netBus.Close()
+	uniqId := contract.AddrConvertToHex(addr) + "0000000000000001"
+	data := make([]byte, 512)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := netBus.SingleCast(context.Background(), uniqId, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNetBus_Broadcast(b *testing.B) {
+	addrs := []string{testHelper.ListenSilent(b).Addr().String(), testHelper.ListenSilent(b).Addr().String(), testHelper.ListenSilent(b).Addr().String()}
+	netBus := newNetBusForTest(addrs)
+	defer netBus.Close()
+	data := make([]byte, 512)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := netBus.Broadcast(context.Background(), data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNetBus_UniqIdCount_UnhealthyGateway(t *testing.T) {
+	gateway := newFakeGateway(t, 3)
+	//网关接收请求，但是迟迟不响应
+	stalled := newFakeGateway(t, 5)
+	stalled.delay = time.Second
+	manger := taskSocket.NewManger()
+	for _, addr := range []string{gateway.addr(), stalled.addr()} {
+		factory := taskSocket.NewFactory(addr, time.Second*5, time.Second*5, time.Second*5)
+		pool := taskSocket.NewPool(2, factory, time.Second, time.Millisecond*20, []byte("~6YOt5rW35piO~"),
+			taskSocket.WithMinIdle(1),
+			taskSocket.WithHealthCheck(taskSocket.HealthCheckConfig{Timeout: time.Millisecond * 50, UnhealthyThreshold: 1}),
+		)
+		pool.LoopHeartbeat()
+		manger.AddSocket(pool)
+	}
+	netBus := NewNetBus(manger)
+	defer netBus.Close()
+	deadline := time.Now().Add(time.Second * 3)
+	for manger.Stats()[stalled.addr()].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled gateway should be marked unhealthy")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	//不健康的网关被立即跳过，不需要等待它的响应超时
+	start := time.Now()
+	res, err := netBus.UniqIdCount(context.Background())
+	if !errors.Is(err, contract.ErrGatewayUnhealthy) {
+		t.Error("UniqIdCount should return contract.ErrGatewayUnhealthy", err)
+	}
+	if time.Since(start) > time.Millisecond*500 {
+		t.Error("UniqIdCount should skip the unhealthy gateway quickly", time.Since(start))
+	}
+	if res.Count() != 3 {
+		t.Error("UniqIdCount failed", res.Count())
+	}
+}
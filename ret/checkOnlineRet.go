@@ -22,6 +22,7 @@ import (
 )
 
 type CheckOnlineRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.CheckOnlineResp
 }
 
@@ -21,5 +21,6 @@ import (
 )
 
 type ConnInfoByCustomerIdRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.ConnInfoByCustomerIdResp
 }
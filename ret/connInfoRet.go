@@ -21,6 +21,7 @@ import (
 )
 
 type ConnInfoRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.ConnInfoResp
 }
 
@@ -21,5 +21,6 @@ import (
 )
 
 type CustomerIdCountRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.CustomerIdCountResp
 }
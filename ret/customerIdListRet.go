@@ -21,5 +21,6 @@ import (
 )
 
 type CustomerIdListRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.CustomerIdListResp
 }
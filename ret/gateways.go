@@ -0,0 +1,71 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package ret
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// Gateway 单个网关在本次请求中的情况
+type Gateway struct {
+	// Addr 网关的task服务器监听的地址
+	Addr string
+	// Latency 从获取socket到解码完响应的耗时
+	Latency time.Duration
+	// Err 请求失败的原因，请求成功则为nil
+	Err error
+}
+
+// Gateways 参与本次请求的所有网关的情况，key是网关的task服务器监听的地址
+type Gateways map[string]*Gateway
+
+// Complete 是否所有网关都请求成功，为false时，Data中缺少失败网关的数据，汇总出来的数量会偏小
+func (g Gateways) Complete() bool {
+	for _, v := range g {
+		if v.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// FailedGateways 请求失败的网关地址，按地址排序
+func (g Gateways) FailedGateways() []string {
+	ret := make([]string, 0)
+	for addr, v := range g {
+		if v.Err != nil {
+			ret = append(ret, addr)
+		}
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+// Err 合并所有失败网关的错误，全部成功则返回nil
+func (g Gateways) Err() error {
+	addrs := g.FailedGateways()
+	if len(addrs) == 0 {
+		return nil
+	}
+	errs := make([]error, 0, len(addrs))
+	for _, addr := range addrs {
+		errs = append(errs, g[addr].Err)
+	}
+	return errors.Join(errs...)
+}
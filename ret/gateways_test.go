@@ -0,0 +1,53 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package ret
+
+import (
+	"errors"
+	"github.com/buexplain/netsvr-protocol-go/v6/netsvrProtocol"
+	"slices"
+	"testing"
+)
+
+func TestGateways(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	res := UniqIdCountRet{
+		Gateways: Gateways{
+			"127.0.0.1:6062": {Addr: "127.0.0.1:6062"},
+			"127.0.0.2:6062": {Addr: "127.0.0.2:6062", Err: errTimeout},
+		},
+		Data: map[string]*netsvrProtocol.UniqIdCountResp{
+			"127.0.0.1:6062": {Count: 3},
+		},
+	}
+	if res.Complete() {
+		t.Error("Complete failed")
+	}
+	if !slices.Equal(res.FailedGateways(), []string{"127.0.0.2:6062"}) {
+		t.Error("FailedGateways failed", res.FailedGateways())
+	}
+	if !errors.Is(res.Err(), errTimeout) {
+		t.Error("Err failed", res.Err())
+	}
+	if res.Count() != 3 {
+		t.Error("Count failed")
+	}
+	res.Gateways["127.0.0.2:6062"].Err = nil
+	if !res.Complete() || res.Err() != nil || len(res.FailedGateways()) != 0 {
+		t.Error("Complete failed")
+	}
+}
@@ -21,5 +21,6 @@ import (
 )
 
 type LimitRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.LimitResp
 }
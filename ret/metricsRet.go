@@ -21,5 +21,6 @@ import (
 )
 
 type MetricsRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.MetricsResp
 }
@@ -21,10 +21,11 @@ import (
 )
 
 type TopicCountRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.TopicCountResp
 }
 
-// Count 获取总数量
+// Count 获取总数量，部分网关请求失败时，总数量会偏小，请结合Complete判断
 func (u *TopicCountRet) Count() int32 {
 	var ret int32
 	for _, v := range u.Data {
@@ -21,5 +21,6 @@ import (
 )
 
 type TopicCustomerIdCountRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.TopicCustomerIdCountResp
 }
@@ -21,5 +21,6 @@ import (
 )
 
 type TopicCustomerIdListRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.TopicCustomerIdListResp
 }
@@ -21,5 +21,6 @@ import (
 )
 
 type TopicCustomerIdToUniqIdsListRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.TopicCustomerIdToUniqIdsListResp
 }
@@ -21,5 +21,6 @@ import (
 )
 
 type TopicListRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.TopicListResp
 }
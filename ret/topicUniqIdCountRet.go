@@ -21,5 +21,6 @@ import (
 )
 
 type TopicUniqIdCountRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.TopicUniqIdCountResp
 }
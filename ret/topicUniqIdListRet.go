@@ -21,5 +21,6 @@ import (
 )
 
 type TopicUniqIdListRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.TopicUniqIdListResp
 }
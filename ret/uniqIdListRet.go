@@ -21,5 +21,6 @@ import (
 )
 
 type UniqIdListRet struct {
+	Gateways
 	Data map[string]*netsvrProtocol.UniqIdListResp
 }
@@ -18,8 +18,12 @@ package socket
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
 	"github.com/buexplain/netsvr-business-go/v2/log"
 	"io"
 	"net"
@@ -35,26 +39,74 @@ type Socket struct {
 	socket         net.Conn
 	socketBufIO    *bufio.Reader
 	connected      int32
+	//读取长度头的buffer，同一时刻只有一个协程在读取
+	header [frameHeaderLen]byte
+	//数据帧负载的最大字节数，小于等于0表示不限制
+	maxFrameSize int
+	oversize     *OversizeCounter
+	traffic      *TrafficCounter
+	//收发失败的次数，调用方主动取消的不计入
+	failures atomic.Uint64
+	//不为nil时通过TLS连接网关
+	tlsConfig *tls.Config
+	dialer    Dialer
 }
 
 const socketConnectedNo = 0
 const socketConnectIng = 1
 const socketConnectedYes = 2
 
-func New(addr string, receiveTimeout time.Duration, sendTimeout time.Duration, connectTimeout time.Duration) *Socket {
-	return &Socket{
+// errConnectBusy 连接已经建立或正在建立中
+var errConnectBusy = errors.New("socket is connected or connecting")
+
+// aLongTimeAgo 用于打断阻塞中的读写操作
+var aLongTimeAgo = time.Unix(1, 0)
+
+func New(addr string, receiveTimeout time.Duration, sendTimeout time.Duration, connectTimeout time.Duration, opts ...Option) *Socket {
+	tmp := &Socket{
 		addr:           addr,
 		receiveTimeout: receiveTimeout,
 		sendTimeout:    sendTimeout,
 		connectTimeout: connectTimeout,
 		connected:      0,
 	}
+	for _, opt := range opts {
+		opt(tmp)
+	}
+	if tmp.oversize == nil {
+		tmp.oversize = &OversizeCounter{}
+	}
+	if tmp.traffic == nil {
+		tmp.traffic = &TrafficCounter{}
+	}
+	return tmp
 }
 
 func (s *Socket) GetAddr() string {
 	return s.addr
 }
 
+// OversizeCounter 超限数据帧的计数器
+func (s *Socket) OversizeCounter() *OversizeCounter {
+	return s.oversize
+}
+
+// TrafficCounter 收发字节数的计数器
+func (s *Socket) TrafficCounter() *TrafficCounter {
+	return s.traffic
+}
+
+// CheckFrameSize 检查待发送的数据帧负载是否超过最大字节数，超过时计数并返回contract.ErrFrameTooLarge
+func (s *Socket) CheckFrameSize(size int) error {
+	if s.maxFrameSize <= 0 || size <= s.maxFrameSize {
+		return nil
+	}
+	s.oversize.sent.Add(1)
+	err := fmt.Errorf("%w: send %d bytes, max %d bytes", contract.ErrFrameTooLarge, size, s.maxFrameSize)
+	log.Info("send message to "+s.addr+" failed", "error", err)
+	return err
+}
+
 func (s *Socket) IsConnected() bool {
 	return atomic.LoadInt32(&s.connected) == socketConnectedYes
 }
@@ -73,108 +125,319 @@ func (s *Socket) Close() {
 }
 
 func (s *Socket) Connect() bool {
+	return s.ConnectContext(context.Background()) == nil
+}
+
+// ConnectContext 连接到网关，ctx的截止时间与取消会作用于拨号过程
+func (s *Socket) ConnectContext(ctx context.Context) error {
 	if atomic.CompareAndSwapInt32(&s.connected, socketConnectedNo, socketConnectIng) {
 		defer atomic.CompareAndSwapInt32(&s.connected, socketConnectIng, socketConnectedNo)
-		d := net.Dialer{
-			Timeout: s.connectTimeout,
-		}
-		conn, err := d.Dial("tcp", s.addr)
+		conn, err := s.dial(ctx)
 		if err != nil {
 			log.Info("connect to "+s.addr+" failed", "error", err)
-			return false
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("%w: %w", contract.ErrGatewayDisconnected, err)
 		}
+		//先赋值再标记为已连接，并发的Close在标记之后才会读取s.socket
+		s.socket = conn
+		s.socketBufIO = bufio.NewReaderSize(conn, 65536)
 		if atomic.CompareAndSwapInt32(&s.connected, socketConnectIng, socketConnectedYes) {
-			s.socket = conn
-			s.socketBufIO = bufio.NewReaderSize(conn, 65536)
-			return true
+			return nil
 		} else {
 			_ = conn.Close()
 		}
 	}
-	return false
+	return errConnectBusy
 }
 
-func (s *Socket) Send(message []byte) bool {
-	totalLen := len(message)
-	data := make([]byte, totalLen+4)
-	binary.BigEndian.PutUint32(data[0:4], uint32(totalLen))
-	totalLen += 4
-	copy(data[4:totalLen], message)
+// dial 建立连接，设置了tls时完成握手，connectTimeout同时作用于拨号与握手
+func (s *Socket) dial(ctx context.Context) (net.Conn, error) {
+	if s.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.connectTimeout)
+		defer cancel()
+	}
+	var conn net.Conn
 	var err error
-	var writeLen int
-	//写入到连接中
-	for {
-		//设置写超时
-		var timeout time.Time
-		if s.sendTimeout > 0 {
-			timeout = time.Now().Add(s.sendTimeout)
-		} else {
-			timeout = time.Time{}
+	if s.dialer == nil {
+		d := net.Dialer{}
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = s.dialer(ctx, s.addr)
+	}
+	if err != nil || s.tlsConfig == nil {
+		return conn, err
+	}
+	config := s.tlsConfig
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		//与tls.Dialer一致，使用地址中的主机名校验网关的证书
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(s.addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (s *Socket) Send(message []byte) bool {
+	return s.SendContext(context.Background(), message) == nil
+}
+
+// SendContext 发送数据，长度头与数据通过一次writev写入，不会拷贝数据，ctx的截止时间与取消会作用于写入过程
+func (s *Socket) SendContext(ctx context.Context, message []byte) error {
+	if err := s.CheckFrameSize(len(message)); err != nil {
+		return err
+	}
+	header := make([]byte, frameHeaderLen)
+	binary.BigEndian.PutUint32(header, uint32(len(message)))
+	return s.writeBuffers(ctx, net.Buffers{header, message})
+}
+
+// SendFrameContext 发送一个数据帧，数据帧已经包含了长度头，直接写入连接，发送完毕后由调用方Release
+func (s *Socket) SendFrameContext(ctx context.Context, frame *Frame) error {
+	if err := s.CheckFrameSize(frame.Len()); err != nil {
+		return err
+	}
+	if err := s.beginWrite(ctx); err != nil {
+		return err
+	}
+	if ctx.Done() != nil {
+		defer s.watch(ctx, s.socket.SetWriteDeadline)()
+	}
+	//net.Conn的Write会写完所有数据或者返回错误
+	writeLen, err := s.socket.Write(frame.bytes())
+	return s.endWrite(ctx, int64(writeLen), err)
+}
+
+// SendFramesContext 发送多个数据帧，所有数据帧通过一次writev写入，任意一个数据帧超限时不写入任何数据，发送完毕后由调用方Release
+func (s *Socket) SendFramesContext(ctx context.Context, frames []*Frame) error {
+	buffers := make(net.Buffers, 0, len(frames))
+	for _, frame := range frames {
+		if err := s.CheckFrameSize(frame.Len()); err != nil {
+			return err
 		}
-		if err = s.socket.SetWriteDeadline(timeout); err != nil {
-			if s.IsConnected() {
-				log.Info("set write timeout failed", "error", err)
-			}
-			return false
+		buffers = append(buffers, frame.bytes())
+	}
+	return s.writeBuffers(ctx, buffers)
+}
+
+// SendBuffersContext 发送多条数据，所有数据连同各自的长度头通过一次writev写入，任意一条数据超限时不写入任何数据，ctx的截止时间与取消会作用于写入过程
+func (s *Socket) SendBuffersContext(ctx context.Context, messages [][]byte) error {
+	headers := make([]byte, frameHeaderLen*len(messages))
+	buffers := make(net.Buffers, 0, 2*len(messages))
+	for i, message := range messages {
+		if err := s.CheckFrameSize(len(message)); err != nil {
+			return err
 		}
-		//写入数据
-		writeLen, err = s.socket.Write(data)
-		//写入成功
-		if err == nil {
-			//写入成功
-			if writeLen == len(data) {
-				return true
-			}
-			//短写，继续写入
-			data = data[writeLen:]
-			time.Sleep(time.Millisecond * 10)
-			continue
+		header := headers[i*frameHeaderLen : (i+1)*frameHeaderLen]
+		binary.BigEndian.PutUint32(header, uint32(len(message)))
+		buffers = append(buffers, header, message)
+	}
+	return s.writeBuffers(ctx, buffers)
+}
+
+// writeBuffers 把buffers写入连接，ctx的截止时间与取消会作用于写入过程
+func (s *Socket) writeBuffers(ctx context.Context, buffers net.Buffers) error {
+	if err := s.beginWrite(ctx); err != nil {
+		return err
+	}
+	if ctx.Done() != nil {
+		defer s.watch(ctx, s.socket.SetWriteDeadline)()
+	}
+	//WriteTo内部会处理短写
+	writeLen, err := buffers.WriteTo(s.socket)
+	return s.endWrite(ctx, writeLen, err)
+}
+
+// beginWrite 检查连接并设置写超时
+func (s *Socket) beginWrite(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !s.IsConnected() {
+		s.fail(ctx)
+		return contract.ErrGatewayDisconnected
+	}
+	if err := s.socket.SetWriteDeadline(s.deadline(ctx, s.sendTimeout)); err != nil {
+		s.fail(ctx)
+		if s.IsConnected() {
+			log.Info("set write timeout failed", "error", err)
 		}
-		//写入错误
-		//没有写入任何数据，tcp管道未被污染，丢弃本次数据，并打印日志
-		var opErr *net.OpError
-		if errors.As(err, &opErr) && opErr.Timeout() && totalLen == len(data[writeLen:]) {
-			if s.IsConnected() {
-				log.Info("send message to "+s.addr+" timeout", "error", err)
-			}
-			return false
+		return wrapError(ctx, err)
+	}
+	return nil
+}
+
+// endWrite 处理写入的结果，writeLen是已经写入的字节数
+func (s *Socket) endWrite(ctx context.Context, writeLen int64, err error) error {
+	if writeLen > 0 {
+		s.traffic.sent.Add(uint64(writeLen))
+	}
+	if err == nil {
+		return nil
+	}
+	s.fail(ctx)
+	//没有写入任何数据，tcp管道未被污染，丢弃本次数据，并打印日志
+	//tls连接写超时后不能再使用，必须关闭
+	if writeLen == 0 && isTimeout(err) && s.tlsConfig == nil {
+		err = wrapError(ctx, err)
+		if s.IsConnected() {
+			log.Info("send message to "+s.addr+" timeout", "error", err)
 		}
-		//写入过部分数据，tcp管道已污染，对端已经无法拆包，必须关闭连接
-		s.close()
-		return false
+		return err
 	}
+	//写入过部分数据，tcp管道已污染，对端已经无法拆包，必须关闭连接
+	s.close()
+	return wrapError(ctx, err)
 }
 
 func (s *Socket) Receive() []byte {
-	var timeout time.Time
-	if s.receiveTimeout > 0 {
-		timeout = time.Now().Add(s.receiveTimeout)
-	} else {
-		timeout = time.Time{}
+	data, _ := s.ReceiveContext(context.Background())
+	return data
+}
+
+// ReceiveContext 接收数据，返回的数据归调用方所有，ctx的截止时间与取消会作用于读取过程
+func (s *Socket) ReceiveContext(ctx context.Context) ([]byte, error) {
+	var data []byte
+	err := s.read(ctx, func(n int) []byte {
+		data = make([]byte, n)
+		return data
+	})
+	if err != nil {
+		return nil, err
 	}
-	if err := s.socket.SetReadDeadline(timeout); err != nil {
+	return data, nil
+}
+
+// ReceiveFrameContext 接收数据到frame中，复用frame的buffer，数据通过frame.Payload获取，ctx的截止时间与取消会作用于读取过程
+func (s *Socket) ReceiveFrameContext(ctx context.Context, frame *Frame) error {
+	return s.read(ctx, func(n int) []byte {
+		frame.grow(n)
+		return frame.Payload()
+	})
+}
+
+// read 读取一个数据帧，alloc根据数据的长度返回用于存放数据的buffer
+func (s *Socket) read(ctx context.Context, alloc func(n int) []byte) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			s.fail(ctx)
+		}
+	}()
+	if !s.IsConnected() {
+		return contract.ErrGatewayDisconnected
+	}
+	if err := s.socket.SetReadDeadline(s.deadline(ctx, s.receiveTimeout)); err != nil {
 		if s.IsConnected() {
 			s.close()
 			log.Info("set read timeout failed", "error", err)
 		}
-		return nil
+		return wrapError(ctx, err)
 	}
-	data := make([]byte, 4)
-	if _, err := io.ReadFull(s.socketBufIO, data); err != nil {
+	if ctx.Done() != nil {
+		defer s.watch(ctx, s.socket.SetReadDeadline)()
+	}
+	if _, err := io.ReadFull(s.socketBufIO, s.header[:]); err != nil {
+		err = wrapError(ctx, err)
 		if s.IsConnected() {
 			s.close()
 			log.Info("read message length from "+s.addr+" failed", "error", err)
 		}
-		return nil
+		return err
 	}
-	dataLen := binary.BigEndian.Uint32(data)
-	data = make([]byte, dataLen)
-	if _, err := io.ReadAtLeast(s.socketBufIO, data, int(dataLen)); err != nil {
+	size := int(binary.BigEndian.Uint32(s.header[:]))
+	if s.maxFrameSize > 0 && size > s.maxFrameSize {
+		//长度头不可信，无法跳过这个数据帧，必须关闭连接
+		s.oversize.received.Add(1)
+		err := fmt.Errorf("%w: receive %d bytes, max %d bytes", contract.ErrFrameTooLarge, size, s.maxFrameSize)
 		if s.IsConnected() {
 			s.close()
 			log.Info("read message from "+s.addr+" failed", "error", err)
 		}
-		return nil
+		return err
 	}
-	return data
+	data := alloc(size)
+	if _, err := io.ReadFull(s.socketBufIO, data); err != nil {
+		err = wrapError(ctx, err)
+		if s.IsConnected() {
+			s.close()
+			log.Info("read message from "+s.addr+" failed", "error", err)
+		}
+		return err
+	}
+	s.traffic.received.Add(uint64(frameHeaderLen + size))
+	return nil
+}
+
+// deadline 计算读写的截止时间，取超时时间与ctx截止时间中较早的那个
+func (s *Socket) deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+	return t
+}
+
+// watch 监听ctx的取消，取消时将截止时间设置为过去，从而打断阻塞中的读写，返回的函数用于停止监听
+// ctx.Done()为nil时不需要监听，调用方应当直接跳过，避免额外的内存分配
+func (s *Socket) watch(ctx context.Context, setDeadline func(t time.Time) error) func() {
+	done := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(done)
+		_ = setDeadline(aLongTimeAgo)
+	})
+	return func() {
+		if !stop() {
+			<-done
+		}
+	}
+}
+
+// isTimeout 是否是读写超时的错误
+func isTimeout(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Timeout()
+}
+
+// Failures 收发失败的次数，包括在已经断开的连接上收发，调用方的ctx被取消或者到达截止时间导致的失败不计入
+func (s *Socket) Failures() uint64 {
+	return s.failures.Load()
+}
+
+// fail 记录一次收发失败，只记录连接本身的失败，因ctx结束而失败时不记录
+func (s *Socket) fail(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	//ctx的截止时间早于读写超时，截止时间到达后ctx.Err()可能还没有被设置
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return
+	}
+	s.failures.Add(1)
+}
+
+// wrapError 将读写错误转换为contract中定义的错误，因ctx结束而失败时，返回ctx的错误
+func wrapError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", contract.ErrGatewayTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", contract.ErrGatewayDisconnected, err)
 }
@@ -0,0 +1,124 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package socket
+
+import (
+	"encoding/binary"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"sync/atomic"
+)
+
+// frameHeaderLen 数据帧的长度头的字节数
+const frameHeaderLen = 4
+
+// maxPooledFrameCap 超过该容量的buffer不放回池中，避免偶发的大数据帧长期占用内存
+const maxPooledFrameCap = 1 << 20
+
+var framePool = sync.Pool{
+	New: func() any {
+		return &Frame{buf: make([]byte, frameHeaderLen, 512)}
+	},
+}
+
+// Frame 一个数据帧，格式是：长度(4字节)+负载，负载通常是cmd(4字节)+protobuf编码的数据
+// 长度头、cmd与编码后的数据都写在同一个从池中获取的buffer里，发送时不再拷贝
+// Frame通过引用计数归还到池中，每次Retain都需要对应一次Release，Release之后不能再访问
+type Frame struct {
+	buf  []byte
+	refs atomic.Int32
+}
+
+// AcquireFrame 从池中获取一个空的数据帧，引用计数为1
+func AcquireFrame() *Frame {
+	f := framePool.Get().(*Frame)
+	f.buf = f.buf[:frameHeaderLen]
+	f.fillHeader()
+	f.refs.Store(1)
+	return f
+}
+
+// Retain 增加引用计数，用于把同一个数据帧交给多个持有者
+func (f *Frame) Retain() *Frame {
+	f.refs.Add(1)
+	return f
+}
+
+// Release 减少引用计数，归零时归还到池中
+func (f *Frame) Release() {
+	if f.refs.Add(-1) != 0 {
+		return
+	}
+	if cap(f.buf) <= maxPooledFrameCap {
+		framePool.Put(f)
+	}
+}
+
+// AppendUint32 以大端序追加一个uint32，通常是cmd
+func (f *Frame) AppendUint32(v uint32) {
+	f.buf = binary.BigEndian.AppendUint32(f.buf, v)
+	f.fillHeader()
+}
+
+// Append 追加原始数据
+func (f *Frame) Append(data []byte) {
+	f.buf = append(f.buf, data...)
+	f.fillHeader()
+}
+
+// AppendProto 追加protobuf编码的数据，失败时数据帧保持不变
+func (f *Frame) AppendProto(message proto.Message) error {
+	n := len(f.buf)
+	buf, err := (proto.MarshalOptions{}).MarshalAppend(f.buf, message)
+	if err != nil {
+		f.buf = f.buf[:n]
+		return err
+	}
+	f.buf = buf
+	f.fillHeader()
+	return nil
+}
+
+// Payload 返回不含长度头的负载，接收时是收到的数据，在下一次接收或Release之前有效
+func (f *Frame) Payload() []byte {
+	return f.buf[frameHeaderLen:]
+}
+
+// Len 负载的长度
+func (f *Frame) Len() int {
+	return len(f.buf) - frameHeaderLen
+}
+
+// bytes 返回完整的数据帧，只读，同一个数据帧可以被多个协程同时发送
+func (f *Frame) bytes() []byte {
+	return f.buf
+}
+
+// fillHeader 每次修改负载后填充长度头
+func (f *Frame) fillHeader() {
+	binary.BigEndian.PutUint32(f.buf[0:frameHeaderLen], uint32(len(f.buf)-frameHeaderLen))
+}
+
+// grow 把负载的长度调整为n，容量不足时扩容，原有的数据不保留
+func (f *Frame) grow(n int) {
+	if cap(f.buf) < frameHeaderLen+n {
+		f.buf = make([]byte, frameHeaderLen+n)
+	} else {
+		f.buf = f.buf[:frameHeaderLen+n]
+	}
+	f.fillHeader()
+}
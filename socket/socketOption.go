@@ -0,0 +1,109 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package socket
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+)
+
+// Option Socket的可选配置
+type Option func(s *Socket)
+
+// WithMaxFrameSize 设置数据帧负载的最大字节数，小于等于0表示不限制，默认不限制
+// 收到超限的数据帧时关闭连接，发送超限的数据帧时不写入连接，两者都返回contract.ErrFrameTooLarge
+func WithMaxFrameSize(size int) Option {
+	return func(s *Socket) {
+		s.maxFrameSize = size
+	}
+}
+
+// WithOversizeCounter 设置超限数据帧的计数器，多个Socket可以共用一个计数器，默认每个Socket一个计数器
+func WithOversizeCounter(counter *OversizeCounter) Option {
+	return func(s *Socket) {
+		s.oversize = counter
+	}
+}
+
+// WithTLSConfig 通过TLS连接网关，config.Certificates不为空时向网关出示客户端证书，即双向TLS
+// config.ServerName为空时使用地址中的主机名校验网关的证书
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Socket) {
+		s.tlsConfig = config
+	}
+}
+
+// Dialer 建立到网关的连接，addr是Socket的地址，ctx已经包含了连接超时
+type Dialer func(ctx context.Context, addr string) (net.Conn, error)
+
+// WithDialer 设置建立连接的方式，默认通过tcp连接addr，可用于Unix域套接字、代理、指定源地址、测试中的net.Pipe等
+// Socket的地址仍然是网关的task服务器在uniqId中编码的地址，用于按uniqId路由，dialer只决定如何连接过去
+// 设置了WithTLSConfig时，会在dialer返回的连接上进行TLS握手
+func WithDialer(dialer Dialer) Option {
+	return func(s *Socket) {
+		s.dialer = dialer
+	}
+}
+
+// UnixDialer 返回一个总是连接到Unix域套接字path的Dialer，适用于业务进程与网关部署在同一台机器的场景
+func UnixDialer(path string) Dialer {
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, "unix", path)
+	}
+}
+
+// WithTrafficCounter 设置收发字节数的计数器，多个Socket可以共用一个计数器，默认每个Socket一个计数器
+func WithTrafficCounter(counter *TrafficCounter) Option {
+	return func(s *Socket) {
+		s.traffic = counter
+	}
+}
+
+// OversizeCounter 超限数据帧的计数器
+type OversizeCounter struct {
+	received atomic.Uint64
+	sent     atomic.Uint64
+}
+
+// Received 收到的超限数据帧的数量
+func (c *OversizeCounter) Received() uint64 {
+	return c.received.Load()
+}
+
+// Sent 拒绝发送的超限数据帧的数量
+func (c *OversizeCounter) Sent() uint64 {
+	return c.sent.Load()
+}
+
+// TrafficCounter 收发字节数的计数器，包含长度头
+type TrafficCounter struct {
+	received atomic.Uint64
+	sent     atomic.Uint64
+}
+
+// Received 接收的字节数
+func (c *TrafficCounter) Received() uint64 {
+	return c.received.Load()
+}
+
+// Sent 发送的字节数
+func (c *TrafficCounter) Sent() uint64 {
+	return c.sent.Load()
+}
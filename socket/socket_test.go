@@ -17,9 +17,21 @@
 package socket
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"errors"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
 	"github.com/buexplain/netsvr-protocol-go/v6/netsvrProtocol"
 	"google.golang.org/protobuf/proto"
+	"math/big"
+	"net"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -42,6 +54,7 @@ func TestSocket_NewSocket(t *testing.T) {
 }
 
 func TestSocket_Connect(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	s := New("127.0.0.1:6062", time.Second*5, time.Second*5, time.Second*5)
 	if s.Connect() != true {
 		t.Error("连接失败")
@@ -56,6 +69,7 @@ func TestSocket_Connect(t *testing.T) {
 }
 
 func TestSocket_Send(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	s := New("127.0.0.1:6062", time.Second*5, time.Second*5, time.Second*5)
 	s.Connect()
 	defer s.Close()
@@ -65,6 +79,7 @@ func TestSocket_Send(t *testing.T) {
 }
 
 func TestSocket_Receive(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	s := New("127.0.0.1:6062", time.Second*5, time.Second*5, time.Second*5)
 	s.Connect()
 	defer s.Close()
@@ -94,3 +109,457 @@ func TestSocket_Close(t *testing.T) {
 		t.Error("关闭失败")
 	}
 }
+
+func TestSocket_ReceiveContext_Cancel(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	defer ln.Close()
+	s := New(ln.Addr().String(), time.Second*5, time.Second*5, time.Second*5)
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal("连接失败", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	start := time.Now()
+	data, err := s.ReceiveContext(ctx)
+	if data != nil || !errors.Is(err, context.Canceled) {
+		t.Error("取消后应该返回context.Canceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("取消没有打断读取")
+	}
+	if s.IsConnected() {
+		t.Error("读取被打断后连接应该被关闭")
+	}
+}
+
+func TestSocket_ReceiveContext_Deadline(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	defer ln.Close()
+	s := New(ln.Addr().String(), time.Second*5, time.Second*5, time.Second*5)
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal("连接失败", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := s.SendContext(ctx, []byte("~6YOt5rW35piO~")); err != nil {
+		t.Fatal("发送失败", err)
+	}
+	start := time.Now()
+	if _, err := s.ReceiveContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("超时后应该返回context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("ctx的截止时间没有生效")
+	}
+}
+
+func TestSocket_SendContext_Canceled(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	defer ln.Close()
+	s := New(ln.Addr().String(), time.Second*5, time.Second*5, time.Second*5)
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal("连接失败", err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.SendContext(ctx, []byte("~6YOt5rW35piO~")); !errors.Is(err, context.Canceled) {
+		t.Error("ctx已经取消，发送应该失败", err)
+	}
+	if !s.IsConnected() {
+		t.Error("没有写入任何数据，连接不应该被关闭")
+	}
+}
+
+func TestSocket_SendBuffersContext(t *testing.T) {
+	received := make(chan string, 3)
+	ln := testHelper.Listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			body, err := testHelper.ReadFrame(conn)
+			if err != nil {
+				return
+			}
+			received <- string(body)
+		}
+	})
+	s := New(ln.Addr().String(), time.Second, time.Second, time.Second)
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendBuffersContext(context.Background(), [][]byte{[]byte("a"), {}, []byte("bc")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"a", "", "bc"} {
+		if v := <-received; v != expected {
+			t.Errorf("expected %q, got %q", expected, v)
+		}
+	}
+}
+
+func TestSocket_MaxFrameSize_Receive(t *testing.T) {
+	ln := testHelper.Listen(t, func(conn net.Conn) {
+		//只写一个声称有1GiB数据的长度头
+		_, _ = conn.Write(binary.BigEndian.AppendUint32(nil, 1<<30))
+		testHelper.Discard(conn)
+	})
+	counter := &OversizeCounter{}
+	s := New(ln.Addr().String(), time.Second, time.Second, time.Second, WithMaxFrameSize(1024), WithOversizeCounter(counter))
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.ReceiveContext(context.Background()); !errors.Is(err, contract.ErrFrameTooLarge) {
+		t.Error("expected contract.ErrFrameTooLarge", err)
+	}
+	if s.IsConnected() {
+		t.Error("socket should be closed after an oversized frame")
+	}
+	if counter.Received() != 1 || s.OversizeCounter() != counter {
+		t.Error("oversized frame should be counted", counter.Received())
+	}
+}
+
+func TestSocket_MaxFrameSize_Send(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	defer ln.Close()
+	s := New(ln.Addr().String(), time.Second, time.Second, time.Second, WithMaxFrameSize(4))
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SendContext(context.Background(), []byte("hello")); !errors.Is(err, contract.ErrFrameTooLarge) {
+		t.Error("expected contract.ErrFrameTooLarge", err)
+	}
+	frame := AcquireFrame()
+	defer frame.Release()
+	frame.Append([]byte("hello"))
+	if err := s.SendFramesContext(context.Background(), []*Frame{frame}); !errors.Is(err, contract.ErrFrameTooLarge) {
+		t.Error("expected contract.ErrFrameTooLarge", err)
+	}
+	if !s.IsConnected() {
+		t.Error("nothing was written, socket should stay connected")
+	}
+	if err := s.SendContext(context.Background(), []byte("hi")); err != nil {
+		t.Error(err)
+	}
+	if s.OversizeCounter().Sent() != 2 {
+		t.Error("oversized frames should be counted", s.OversizeCounter().Sent())
+	}
+}
+
+// issueCert 签发一个证书，parent为nil时签发自签名的CA证书
+func issueCert(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// listenTLS 监听一个要求客户端证书的本地TLS地址，原样回写收到的数据帧，返回地址、CA证书池以及CA签发的客户端证书
+func listenTLS(t *testing.T) (string, *x509.CertPool, tls.Certificate) {
+	ca := issueCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "netsvr test ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	server := issueCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "netsvr"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := issueCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "business"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHelper.Serve(t, ln, testHelper.Echo)
+	return ln.Addr().String(), pool, client
+}
+
+// assertEcho 发送一条数据，并检查收到的回写
+func assertEcho(t *testing.T, s *Socket) {
+	if err := s.SendContext(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.ReceiveContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Error("unexpected message", string(data))
+	}
+}
+
+func TestSocket_TLS(t *testing.T) {
+	addr, pool, client := listenTLS(t)
+	s := New(addr, time.Second, time.Second, time.Second, WithTLSConfig(&tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{client},
+	}))
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertEcho(t, s)
+}
+
+func TestSocket_TLS_UntrustedGateway(t *testing.T) {
+	addr, _, client := listenTLS(t)
+	s := New(addr, time.Second, time.Second, time.Second, WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{client},
+	}))
+	err := s.ConnectContext(context.Background())
+	if !errors.Is(err, contract.ErrGatewayDisconnected) {
+		t.Error("gateway certificate should be rejected", err)
+	}
+	var certErr *tls.CertificateVerificationError
+	if !errors.As(err, &certErr) {
+		t.Error("expected *tls.CertificateVerificationError", err)
+	}
+}
+
+func TestSocket_TLS_MissingClientCertificate(t *testing.T) {
+	addr, pool, _ := listenTLS(t)
+	s := New(addr, time.Second, time.Second, time.Second, WithTLSConfig(&tls.Config{
+		RootCAs: pool,
+	}))
+	//tls1.3中网关在握手完成后才校验客户端证书，所以错误出现在第一次读写
+	err := s.ConnectContext(context.Background())
+	if err == nil {
+		defer s.Close()
+		if err = s.SendContext(context.Background(), []byte("hello")); err == nil {
+			_, err = s.ReceiveContext(context.Background())
+		}
+	}
+	if !errors.Is(err, contract.ErrGatewayDisconnected) {
+		t.Error("gateway should reject the connection without client certificate", err)
+	}
+}
+
+func TestSocket_WithDialer_Pipe(t *testing.T) {
+	var dialed string
+	s := New("pipe", time.Second, time.Second, time.Second, WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed = addr
+		return testHelper.PipeDialer(testHelper.Echo)(ctx, addr)
+	}))
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if dialed != "pipe" {
+		t.Error("dialer should receive the socket address", dialed)
+	}
+	assertEcho(t, s)
+}
+
+func TestSocket_WithDialer_Error(t *testing.T) {
+	dialErr := errors.New("proxy refused")
+	s := New("127.0.0.1:6062", time.Second, time.Second, time.Second, WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, dialErr
+	}))
+	if err := s.ConnectContext(context.Background()); !errors.Is(err, contract.ErrGatewayDisconnected) || !errors.Is(err, dialErr) {
+		t.Error("dial error should be wrapped", err)
+	}
+}
+
+func TestSocket_UnixDialer(t *testing.T) {
+	path := t.TempDir() + "/netsvr.sock"
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("unix domain socket is not supported", err)
+	}
+	testHelper.Serve(t, ln, testHelper.Echo)
+	s := New("127.0.0.1:6062", time.Second, time.Second, time.Second, WithDialer(UnixDialer(path)))
+	if err = s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertEcho(t, s)
+}
+
+// benchServer 丢弃收到的数据，或者不断回写固定的数据帧
+func benchServer(b *testing.B, reply []byte) string {
+	if reply == nil {
+		return testHelper.ListenSilent(b).Addr().String()
+	}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(reply)))
+	frame = append(frame, reply...)
+	batch := make([]byte, 0, len(frame)*64)
+	for i := 0; i < 64; i++ {
+		batch = append(batch, frame...)
+	}
+	return testHelper.Listen(b, func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			if _, err := conn.Write(batch); err != nil {
+				return
+			}
+		}
+	}).Addr().String()
+}
+
+func BenchmarkSocket_SendContext(b *testing.B) {
+	s := New(benchServer(b, nil), time.Second, time.Second, time.Second)
+	if err := s.ConnectContext(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	message := make([]byte, 512)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.SendContext(context.Background(), message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSocket_ReceiveContext(b *testing.B) {
+	s := New(benchServer(b, make([]byte, 512)), time.Second, time.Second, time.Second)
+	if err := s.ConnectContext(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	b.ReportAllocs()
+	b.SetBytes(512)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ReceiveContext(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSocket_SendFrameContext(b *testing.B) {
+	s := New(benchServer(b, nil), time.Second, time.Second, time.Second)
+	if err := s.ConnectContext(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	message := make([]byte, 512)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame := AcquireFrame()
+		frame.Append(message)
+		if err := s.SendFrameContext(context.Background(), frame); err != nil {
+			b.Fatal(err)
+		}
+		frame.Release()
+	}
+}
+
+func BenchmarkSocket_ReceiveFrameContext(b *testing.B) {
+	s := New(benchServer(b, make([]byte, 512)), time.Second, time.Second, time.Second)
+	if err := s.ConnectContext(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	frame := AcquireFrame()
+	defer frame.Release()
+	b.ReportAllocs()
+	b.SetBytes(512)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.ReceiveFrameContext(context.Background(), frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSocket_TrafficCounter(t *testing.T) {
+	counter := &TrafficCounter{}
+	s := New("pipe", time.Second, time.Second, time.Second, WithTrafficCounter(counter), WithDialer(testHelper.PipeDialer(testHelper.Echo)))
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertEcho(t, s)
+	if s.TrafficCounter() != counter || counter.Sent() != 9 || counter.Received() != 9 {
+		t.Error("traffic counter mismatch", counter.Sent(), counter.Received())
+	}
+}
+
+func TestSocket_Failures(t *testing.T) {
+	s := New("pipe", time.Second, time.Second, time.Second, WithDialer(testHelper.PipeDialer(testHelper.Discard)))
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	//调用方主动取消，不计入失败
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+	if _, err := s.ReceiveContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatal("ReceiveContext should be canceled", err)
+	}
+	if s.Failures() != 0 {
+		t.Error("canceled receive should not count as failure", s.Failures())
+	}
+	if err := s.SendContext(context.Background(), []byte("hello")); !errors.Is(err, contract.ErrGatewayDisconnected) {
+		t.Fatal("SendContext should fail on a closed socket", err)
+	}
+	if s.Failures() != 1 {
+		t.Error("send failure should be counted", s.Failures())
+	}
+}
+
+func TestSocket_Failures_Deadline(t *testing.T) {
+	s := New("pipe", time.Millisecond*20, time.Second, time.Second, WithDialer(testHelper.PipeDialer(testHelper.Discard)))
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	//调用方的ctx到达截止时间，不计入失败
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if _, err := s.ReceiveContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("ReceiveContext should exceed the deadline", err)
+	}
+	if s.Failures() != 0 {
+		t.Error("deadline exceeded receive should not count as failure", s.Failures())
+	}
+	//连接本身的读超时，计入失败
+	if err := s.ConnectContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReceiveContext(context.Background()); !errors.Is(err, contract.ErrGatewayTimeout) {
+		t.Fatal("ReceiveContext should time out", err)
+	}
+	if s.Failures() != 1 {
+		t.Error("receive timeout should be counted", s.Failures())
+	}
+}
@@ -17,6 +17,7 @@
 package taskSocket
 
 import (
+	"context"
 	"github.com/buexplain/netsvr-business-go/v2/socket"
 	"time"
 )
@@ -24,20 +25,48 @@ import (
 type TaskSocket struct {
 	*socket.Socket
 	pool *Pool
+	//有序通道的socket不属于池，归还时归还通道
+	lane *lane
+	//连接建立的时间，用于MaxLifetime
+	createdAt time.Time
+	//最近一次放回池中的时间，用于MaxIdleTime
+	idleAt time.Time
+	//借出时socket的收发失败次数，归还时据此判断借出期间是否失败，用于熔断器
+	failures uint64
 }
 
-func New(addr string, receiveTimeout time.Duration, sendTimeout time.Duration, connectTimeout time.Duration, pool *Pool) *TaskSocket {
+func New(addr string, receiveTimeout time.Duration, sendTimeout time.Duration, connectTimeout time.Duration, pool *Pool, opts ...socket.Option) *TaskSocket {
 	return &TaskSocket{
 		Socket: socket.New(
 			addr,
 			receiveTimeout,
 			sendTimeout,
 			connectTimeout,
+			opts...,
 		),
 		pool: pool,
 	}
 }
 
 func (t *TaskSocket) Release() {
-	t.pool.release(t)
+	t.pool.report(t)
+	if t.lane != nil {
+		t.pool.releaseLane(t.lane)
+	} else {
+		t.pool.release(t)
+	}
+	t.pool.giveBack(t)
+}
+
+// RoundTripContext 发送请求并接收网关的响应，往返耗时记入池的统计
+func (t *TaskSocket) RoundTripContext(ctx context.Context, req *socket.Frame, resp *socket.Frame) error {
+	start := time.Now()
+	if err := t.SendFrameContext(ctx, req); err != nil {
+		return err
+	}
+	if err := t.ReceiveFrameContext(ctx, resp); err != nil {
+		return err
+	}
+	t.pool.stats.latency.observe(time.Since(start))
+	return nil
 }
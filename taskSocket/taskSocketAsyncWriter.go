@@ -0,0 +1,335 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
+	"sync"
+	"time"
+)
+
+// AsyncWriterConfig 异步写入器的配置
+type AsyncWriterConfig struct {
+	// QueueSize 队列的容量，队列满时Write会等待，默认1024
+	QueueSize int
+	// BatchBytes 累积的数据达到该字节数时立即写入，默认65536
+	BatchBytes int
+	// FlushInterval 数据在队列中最多停留的时间，为0时只要队列空了就立即写入
+	FlushInterval time.Duration
+	// OnError 写入失败时的回调，err是*contract.GatewayError，frames是丢失的数据条数，回调在写入协程中执行，不能阻塞
+	OnError func(err error, frames int)
+}
+
+// asyncFrame 队列中的一条数据，flushed不为nil时表示Flush的标记
+type asyncFrame struct {
+	frame   *socket.Frame
+	flushed chan error
+	//心跳只在连接已经建立时发送，不会为了心跳而建立连接
+	heartbeat bool
+}
+
+// maxAsyncWriterErrs 两次Flush之间保留的写入错误的数量，只依赖OnError而不调用Flush时，错误不会无限累积
+const maxAsyncWriterErrs = 16
+
+// AsyncWriter 异步写入器，独占一个到网关的连接，把队列中的多条数据合并成一次writev写入
+// 写入是至多一次的，写入失败的数据会被丢弃，并通过OnError与Flush报告
+type AsyncWriter struct {
+	pool   *Pool
+	config AsyncWriterConfig
+	queue  chan asyncFrame
+	socket *TaskSocket
+	//上一次Flush以来的写入错误，最多保留maxAsyncWriterErrs个，其余的只计数
+	errs    []error
+	dropped int
+	closed  bool
+	mux     sync.RWMutex
+	done    chan struct{}
+	//作用于连接与写入，CloseContext的ctx结束时取消，打断正在进行的写入，剩余的数据直接丢弃
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newAsyncWriter(pool *Pool, config AsyncWriterConfig) *AsyncWriter {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	if config.BatchBytes <= 0 {
+		config.BatchBytes = 65536
+	}
+	tmp := &AsyncWriter{
+		pool:   pool,
+		config: config,
+		queue:  make(chan asyncFrame, config.QueueSize),
+		done:   make(chan struct{}),
+	}
+	tmp.ctx, tmp.cancel = context.WithCancel(context.Background())
+	go tmp.loop()
+	return tmp
+}
+
+func (w *AsyncWriter) GetAddr() string {
+	return w.pool.GetAddr()
+}
+
+// Write 把数据拷贝到数据帧后放入队列，队列满时等待，直到ctx结束，写入器关闭后返回contract.ErrPoolClosed
+// 返回nil只表示数据已经入队
+func (w *AsyncWriter) Write(ctx context.Context, data []byte) error {
+	frame := socket.AcquireFrame()
+	frame.Append(data)
+	return w.WriteFrame(ctx, frame)
+}
+
+// WriteFrame 把数据帧放入队列，写入器接管frame的引用，写入完毕或者入队失败时Release
+func (w *AsyncWriter) WriteFrame(ctx context.Context, frame *socket.Frame) error {
+	if err := w.enqueue(ctx, asyncFrame{frame: frame}); err != nil {
+		frame.Release()
+		return err
+	}
+	return nil
+}
+
+// Flush 等待Flush之前入队的数据全部写入，返回上一次Flush以来的写入错误，最多包含maxAsyncWriterErrs个，其余的只报告数量
+func (w *AsyncWriter) Flush(ctx context.Context) error {
+	flushed := make(chan error, 1)
+	if err := w.enqueue(ctx, asyncFrame{flushed: flushed}); err != nil {
+		return err
+	}
+	select {
+	case err := <-flushed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *AsyncWriter) enqueue(ctx context.Context, frame asyncFrame) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w.mux.RLock()
+	defer w.mux.RUnlock()
+	if w.closed {
+		return contract.ErrPoolClosed
+	}
+	select {
+	case w.queue <- frame:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len 队列中等待写入的数据条数
+func (w *AsyncWriter) Len() int {
+	return len(w.queue)
+}
+
+func (w *AsyncWriter) loop() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("taskSocket asyncWriter panic", "err", err)
+		}
+		if w.socket != nil {
+			w.socket.Close()
+		}
+		w.cancel()
+		close(w.done)
+	}()
+	batch := make([]*socket.Frame, 0, 64)
+	size := 0
+	flush := func() {
+		if len(batch) > 0 {
+			w.write(batch)
+			for _, frame := range batch {
+				frame.Release()
+			}
+			clear(batch)
+			batch = batch[:0]
+			size = 0
+		}
+	}
+	var timeout <-chan time.Time
+	var timer *time.Timer
+	if w.config.FlushInterval > 0 {
+		timer = time.NewTimer(w.config.FlushInterval)
+		timer.Stop()
+		defer timer.Stop()
+	}
+	for {
+		var frame asyncFrame
+		var ok bool
+		select {
+		case frame, ok = <-w.queue:
+		case <-timeout:
+			timeout = nil
+			flush()
+			continue
+		}
+		if !ok {
+			flush()
+			return
+		}
+		if frame.flushed != nil {
+			flush()
+			frame.flushed <- w.takeErrs()
+			continue
+		}
+		if frame.heartbeat && (w.socket == nil || !w.socket.IsConnected()) {
+			frame.frame.Release()
+			continue
+		}
+		batch = append(batch, frame.frame)
+		size += frame.frame.Len() + 4
+		if size >= w.config.BatchBytes {
+			flush()
+			continue
+		}
+		if timer == nil {
+			//没有设置等待时间，队列空了就立即写入
+			if len(w.queue) == 0 {
+				flush()
+			}
+		} else if len(batch) == 1 {
+			timer.Reset(w.config.FlushInterval)
+			timeout = timer.C
+		}
+	}
+}
+
+// write 写入一批数据，连接断开时先重连，超限的数据帧会被单独丢弃，不影响同一批的其它数据
+// 池已经关闭、池不健康或者熔断器打开时不重连，直接丢弃这一批数据，避免每一批数据都等待一次连接超时
+func (w *AsyncWriter) write(batch []*socket.Frame) {
+	err := w.ctx.Err()
+	redial := w.socket == nil || !w.socket.IsConnected()
+	if err == nil && redial {
+		if w.pool.isClosed() {
+			err = contract.ErrPoolClosed
+		} else if !w.pool.Healthy() {
+			err = contract.ErrGatewayUnhealthy
+		} else if err = w.pool.allow(); err == nil {
+			w.socket, err = w.pool.dial(w.ctx)
+		}
+	}
+	if err != nil {
+		w.fail(err, len(batch))
+		return
+	}
+	//通常没有超限的数据帧，出现超限时才拷贝出其余的数据帧，batch中的数据帧由调用方Release
+	valid := batch
+	oversize := false
+	for i, frame := range batch {
+		if err = w.socket.CheckFrameSize(frame.Len()); err != nil {
+			if !oversize {
+				oversize = true
+				valid = append(make([]*socket.Frame, 0, len(batch)), batch[:i]...)
+			}
+			w.fail(err, 1)
+		} else if oversize {
+			valid = append(valid, frame)
+		}
+	}
+	if len(valid) == 0 {
+		return
+	}
+	err = w.socket.SendFramesContext(w.ctx, valid)
+	if err != nil {
+		w.fail(err, len(valid))
+		//池已经关闭，不再尝试在这个连接上写入剩余的数据
+		if w.pool.isClosed() {
+			w.socket.Close()
+		}
+	}
+	//重连后的第一次写入，结果报告给熔断器，半开时作为试探的请求
+	if redial && w.pool.breaker != nil {
+		if err == nil {
+			w.pool.breaker.succeed()
+		} else {
+			w.pool.breaker.fail()
+		}
+	}
+}
+
+// takeErrs 取出上一次Flush以来的写入错误，超出保留数量的错误合并为一条说明
+func (w *AsyncWriter) takeErrs() error {
+	if w.dropped > 0 {
+		w.errs = append(w.errs, fmt.Errorf("%d more write errors to %s dropped", w.dropped, w.pool.GetAddr()))
+	}
+	err := errors.Join(w.errs...)
+	w.errs = nil
+	w.dropped = 0
+	return err
+}
+
+// fail 记录写入错误，frames是丢失的数据条数
+func (w *AsyncWriter) fail(err error, frames int) {
+	err = &contract.GatewayError{Addr: w.pool.GetAddr(), Err: err}
+	log.Error("taskSocket asyncWriter write to "+w.pool.GetAddr()+" failed", "frames", frames, "error", err)
+	if len(w.errs) < maxAsyncWriterErrs {
+		w.errs = append(w.errs, err)
+	} else {
+		w.dropped++
+	}
+	if w.config.OnError != nil {
+		w.config.OnError(err, frames)
+	}
+}
+
+// heartbeat 连接空闲时发送心跳，由池的心跳协程调用
+func (w *AsyncWriter) heartbeat() {
+	w.mux.RLock()
+	defer w.mux.RUnlock()
+	if w.closed {
+		return
+	}
+	//通过队列发送，避免与写入协程同时写连接
+	frame := socket.AcquireFrame()
+	frame.Append(w.pool.heartbeatMessage)
+	select {
+	case w.queue <- asyncFrame{frame: frame, heartbeat: true}:
+	default:
+		frame.Release()
+	}
+}
+
+// Close 不再接收新的数据，写入队列中剩余的数据后关闭连接，参见CloseContext
+func (w *AsyncWriter) Close() {
+	_ = w.CloseContext(context.Background())
+}
+
+// CloseContext 不再接收新的数据，写入队列中剩余的数据后关闭连接
+// ctx结束时打断正在进行的写入，队列中剩余的数据被丢弃并通过OnError报告，然后返回ctx.Err()
+func (w *AsyncWriter) CloseContext(ctx context.Context) error {
+	w.mux.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mux.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+	}
+	w.cancel()
+	<-w.done
+	return ctx.Err()
+}
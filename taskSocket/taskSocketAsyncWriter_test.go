@@ -0,0 +1,269 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"context"
+	"errors"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenFrames 监听一个本地地址，把收到的数据帧按顺序放入返回的通道
+func listenFrames(t *testing.T) (net.Listener, <-chan string) {
+	frames := make(chan string, 1024)
+	ln := testHelper.Listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			body, err := testHelper.ReadFrame(conn)
+			if err != nil {
+				return
+			}
+			frames <- string(body)
+		}
+	})
+	return ln, frames
+}
+
+func TestAsyncWriter_Flush(t *testing.T) {
+	ln, frames := listenFrames(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(1, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"), WithAsyncWriter(AsyncWriterConfig{BatchBytes: 64}))
+	defer pool.Close()
+	writer := pool.AsyncWriter()
+	for i := 0; i < 100; i++ {
+		if err := writer.Write(context.Background(), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if v := <-frames; v != strconv.Itoa(i) {
+			t.Fatalf("expected %d, got %s", i, v)
+		}
+	}
+}
+
+func TestAsyncWriter_FlushInterval(t *testing.T) {
+	ln, frames := listenFrames(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	interval := time.Millisecond * 50
+	pool := NewPool(1, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"), WithAsyncWriter(AsyncWriterConfig{FlushInterval: interval}))
+	defer pool.Close()
+	start := time.Now()
+	if err := pool.AsyncWriter().Write(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if v := <-frames; v != "hello" {
+		t.Error("unexpected frame", v)
+	}
+	if time.Since(start) < interval {
+		t.Error("frame should wait for FlushInterval", time.Since(start))
+	}
+}
+
+func TestAsyncWriter_OnError(t *testing.T) {
+	addr := testHelper.DeadAddr(t)
+	var lost atomic.Int64
+	factory := NewFactory(addr, time.Second, time.Second, time.Second)
+	pool := NewPool(1, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"), WithAsyncWriter(AsyncWriterConfig{
+		OnError: func(err error, frames int) {
+			lost.Add(int64(frames))
+		},
+	}))
+	writer := pool.AsyncWriter()
+	for i := 0; i < 3; i++ {
+		if err := writer.Write(context.Background(), []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Flush(context.Background())
+	var gatewayErr *contract.GatewayError
+	if !errors.As(err, &gatewayErr) || gatewayErr.Addr != addr || !errors.Is(err, contract.ErrGatewayDisconnected) {
+		t.Error("Flush should report the write error", err)
+	}
+	if lost.Load() != 3 {
+		t.Error("OnError should report the lost frames", lost.Load())
+	}
+	if err = writer.Flush(context.Background()); err != nil {
+		t.Error("Flush should only report errors since the last Flush", err)
+	}
+	pool.Close()
+	if err = writer.Write(context.Background(), []byte("hello")); !errors.Is(err, contract.ErrPoolClosed) {
+		t.Error("Write should return contract.ErrPoolClosed after Close", err)
+	}
+}
+
+func TestAsyncWriter_MaxFrameSize(t *testing.T) {
+	ln, frames := listenFrames(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second, socket.WithMaxFrameSize(4))
+	pool := NewPool(1, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"), WithAsyncWriter(AsyncWriterConfig{FlushInterval: time.Second}))
+	defer pool.Close()
+	writer := pool.AsyncWriter()
+	for _, v := range []string{"hi", "hello", "ok"} {
+		if err := writer.Write(context.Background(), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(context.Background()); !errors.Is(err, contract.ErrFrameTooLarge) {
+		t.Error("Flush should report the oversized frame", err)
+	}
+	//同一批的其它数据不受影响
+	for _, expected := range []string{"hi", "ok"} {
+		if v := <-frames; v != expected {
+			t.Errorf("expected %q, got %q", expected, v)
+		}
+	}
+	if factory.OversizeCounter().Sent() != 1 {
+		t.Error("oversized frame should be counted", factory.OversizeCounter().Sent())
+	}
+}
+
+func TestAsyncWriter_MaxErrs(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	var reported atomic.Int64
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second, socket.WithMaxFrameSize(4))
+	pool := NewPool(1, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"), WithAsyncWriter(AsyncWriterConfig{
+		FlushInterval: time.Second,
+		OnError: func(err error, frames int) {
+			reported.Add(1)
+		},
+	}))
+	defer pool.Close()
+	writer := pool.AsyncWriter()
+	total := maxAsyncWriterErrs + 4
+	for i := 0; i < total; i++ {
+		if err := writer.Write(context.Background(), []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Flush(context.Background())
+	//OnError收到全部错误，Flush最多保留maxAsyncWriterErrs个，其余的只报告数量
+	if reported.Load() != int64(total) {
+		t.Error("OnError should receive every error", reported.Load())
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) != maxAsyncWriterErrs+1 || !strings.Contains(err.Error(), "4 more write errors") {
+		t.Error("Flush should cap the errors", err)
+	}
+	if len(writer.errs) != 0 || writer.dropped != 0 {
+		t.Error("Flush should reset the errors")
+	}
+}
+
+func TestAsyncWriter_Unhealthy(t *testing.T) {
+	var dials atomic.Int32
+	g := &toggleGateway{}
+	factory := NewFactory("pipe", time.Second, time.Second, time.Second, socket.WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return g.dial(ctx, addr)
+	}))
+	pool := NewPool(1, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"), WithHealthCheck(HealthCheckConfig{}), WithAsyncWriter(AsyncWriterConfig{}))
+	defer pool.Close()
+	pool.health.unhealthy.Store(true)
+	if err := pool.AsyncWriter().Write(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.AsyncWriter().Flush(context.Background()); !errors.Is(err, contract.ErrGatewayUnhealthy) {
+		t.Error("Flush should return contract.ErrGatewayUnhealthy", err)
+	}
+	if dials.Load() != 0 {
+		t.Error("unhealthy pool should not be dialed", dials.Load())
+	}
+}
+
+func TestAsyncWriter_PoolClosed(t *testing.T) {
+	var dials atomic.Int32
+	release := make(chan struct{})
+	factory := NewFactory("pipe", time.Second, time.Second, time.Hour, socket.WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		dials.Add(1)
+		<-release
+		return nil, errors.New("connection refused")
+	}))
+	var lost atomic.Int64
+	pool := NewPool(1, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"), WithAsyncWriter(AsyncWriterConfig{
+		BatchBytes: 1,
+		OnError: func(err error, frames int) {
+			lost.Add(int64(frames))
+		},
+	}))
+	for i := 0; i < 5; i++ {
+		if err := pool.AsyncWriter().Write(context.Background(), []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(done)
+	}()
+	<-pool.closedCh
+	close(release)
+	//池关闭后不再重连，剩余的数据被直接丢弃
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("Close should not wait for a dial per batch")
+	}
+	if dials.Load() > 1 || lost.Load() != 5 {
+		t.Error("closed pool should fail the remaining batches fast", dials.Load(), lost.Load())
+	}
+}
+
+func TestAsyncWriter_CloseContext(t *testing.T) {
+	dialed := make(chan struct{})
+	factory := NewFactory("pipe", time.Second, time.Hour, time.Second, socket.WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		defer close(dialed)
+		//对端不读取，写入一直阻塞
+		client, _ := net.Pipe()
+		return client, nil
+	}))
+	var lost atomic.Int64
+	pool := NewPool(1, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"), WithAsyncWriter(AsyncWriterConfig{
+		BatchBytes: 1,
+		OnError: func(err error, frames int) {
+			lost.Add(int64(frames))
+		},
+	}))
+	for i := 0; i < 3; i++ {
+		if err := pool.AsyncWriter().Write(context.Background(), []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-dialed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	if err := pool.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("CloseContext should return context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("CloseContext should interrupt the pending write", time.Since(start))
+	}
+	if lost.Load() != 3 {
+		t.Error("remaining frames should be reported as lost", lost.Load())
+	}
+}
@@ -0,0 +1,191 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BreakerState 熔断器的状态
+type BreakerState int32
+
+const (
+	// BreakerClosed 关闭，请求正常通过
+	BreakerClosed BreakerState = iota
+	// BreakerOpen 打开，请求被立即拒绝
+	BreakerOpen
+	// BreakerHalfOpen 半开，只放行一个试探的请求，其余请求被拒绝
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerConfig 熔断器的配置，参见WithCircuitBreaker
+type BreakerConfig struct {
+	//连续失败多少次后打开熔断器，默认是5
+	FailureThreshold int
+	//打开多久后放行一个试探的请求，默认是5秒，试探的请求没有结果时，同样在OpenTimeout后再放行一个
+	OpenTimeout time.Duration
+	//状态变化的回调，在引起变化的协程中同步执行，不能阻塞，可以为nil
+	OnStateChange func(addr string, from BreakerState, to BreakerState)
+}
+
+// breaker 熔断器，连接网关失败，以及借出期间收发失败都计为一次失败，归还时没有收发失败计为一次成功
+type breaker struct {
+	addr   string
+	config BreakerConfig
+	state  atomic.Int32
+	//关闭状态下连续失败的次数
+	failures atomic.Int64
+	opens    atomic.Uint64
+	mux      sync.Mutex
+	//打开的时间，半开状态下是最近一次放行试探请求的时间
+	openedAt time.Time
+}
+
+func newBreaker(addr string, config BreakerConfig) *breaker {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 5
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = time.Second * 5
+	}
+	return &breaker{addr: addr, config: config}
+}
+
+func (b *breaker) State() BreakerState {
+	return BreakerState(b.state.Load())
+}
+
+// allow 熔断器是否放行本次请求，不放行时返回*contract.CircuitOpenError
+func (b *breaker) allow() error {
+	if b.State() == BreakerClosed {
+		return nil
+	}
+	b.mux.Lock()
+	from := b.State()
+	if from == BreakerClosed {
+		b.mux.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if retryAt := b.openedAt.Add(b.config.OpenTimeout); now.Before(retryAt) {
+		b.mux.Unlock()
+		return &contract.CircuitOpenError{Addr: b.addr, RetryAt: retryAt}
+	}
+	b.openedAt = now
+	b.state.Store(int32(BreakerHalfOpen))
+	b.mux.Unlock()
+	b.notify(from, BreakerHalfOpen)
+	return nil
+}
+
+func (b *breaker) succeed() {
+	if b.State() == BreakerClosed {
+		if b.failures.Load() != 0 {
+			b.failures.Store(0)
+		}
+		return
+	}
+	b.mux.Lock()
+	from := b.State()
+	//打开状态下，打开前借出的请求陆续成功归还，不能代替试探的请求，只有半开状态下的成功才能关闭熔断器
+	if from != BreakerHalfOpen {
+		b.mux.Unlock()
+		return
+	}
+	b.failures.Store(0)
+	b.state.Store(int32(BreakerClosed))
+	b.mux.Unlock()
+	b.notify(from, BreakerClosed)
+}
+
+func (b *breaker) fail() {
+	b.mux.Lock()
+	from := b.State()
+	//打开状态下，打开前借出的请求陆续失败，不影响打开的时间
+	if from == BreakerOpen || (from == BreakerClosed && b.failures.Add(1) < int64(b.config.FailureThreshold)) {
+		b.mux.Unlock()
+		return
+	}
+	b.openedAt = time.Now()
+	b.state.Store(int32(BreakerOpen))
+	b.opens.Add(1)
+	b.mux.Unlock()
+	b.notify(from, BreakerOpen)
+}
+
+// notify 记录日志并执行回调，回调的panic不会影响请求
+func (b *breaker) notify(from BreakerState, to BreakerState) {
+	if to == BreakerOpen {
+		log.Error("taskSocketPool "+b.addr+" circuit breaker open", "from", from.String())
+	} else {
+		log.Info("taskSocketPool "+b.addr+" circuit breaker "+to.String(), "from", from.String())
+	}
+	if b.config.OnStateChange == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("taskSocketPool circuit breaker hook panic", "err", err, "stack", debug.Stack())
+		}
+	}()
+	b.config.OnStateChange(b.addr, from, to)
+}
+
+// BreakerState 熔断器的状态，没有开启熔断器时总是BreakerClosed
+func (t *Pool) BreakerState() BreakerState {
+	if t.breaker == nil {
+		return BreakerClosed
+	}
+	return t.breaker.State()
+}
+
+// allow 熔断器是否放行本次连接或者请求，没有开启熔断器时总是放行
+func (t *Pool) allow() error {
+	if t.breaker == nil {
+		return nil
+	}
+	return t.breaker.allow()
+}
+
+// report 按借出期间是否有收发失败，向熔断器报告本次请求的结果
+func (t *Pool) report(s *TaskSocket) {
+	if t.breaker == nil {
+		return
+	}
+	if s.Failures() == s.failures {
+		t.breaker.succeed()
+	} else {
+		t.breaker.fail()
+	}
+}
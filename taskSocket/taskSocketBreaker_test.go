@@ -0,0 +1,240 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"context"
+	"errors"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// breakerRecorder 记录熔断器的状态变化
+type breakerRecorder struct {
+	mux     sync.Mutex
+	changes []BreakerState
+}
+
+func (r *breakerRecorder) record(_ string, _ BreakerState, to BreakerState) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.changes = append(r.changes, to)
+}
+
+func (r *breakerRecorder) get() []BreakerState {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]BreakerState(nil), r.changes...)
+}
+
+func TestBreaker(t *testing.T) {
+	recorder := &breakerRecorder{}
+	b := newBreaker("127.0.0.1:6061", BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Millisecond * 50, OnStateChange: recorder.record})
+	b.fail()
+	if err := b.allow(); err != nil || b.State() != BreakerClosed {
+		t.Fatal("breaker should stay closed below the threshold", err)
+	}
+	//成功后连续失败的次数清零
+	b.succeed()
+	b.fail()
+	if b.State() != BreakerClosed {
+		t.Fatal("breaker should count consecutive failures only")
+	}
+	b.fail()
+	err := b.allow()
+	var circuitErr *contract.CircuitOpenError
+	if !errors.As(err, &circuitErr) || !errors.Is(err, contract.ErrCircuitOpen) || circuitErr.Addr != "127.0.0.1:6061" {
+		t.Fatal("open breaker should reject with *contract.CircuitOpenError", err)
+	}
+	time.Sleep(time.Until(circuitErr.RetryAt))
+	//只放行一个试探的请求
+	if err = b.allow(); err != nil || b.State() != BreakerHalfOpen {
+		t.Fatal("breaker should let a probe through after OpenTimeout", err)
+	}
+	if err = b.allow(); !errors.Is(err, contract.ErrCircuitOpen) {
+		t.Fatal("half-open breaker should reject other requests", err)
+	}
+	//试探失败，重新打开
+	b.fail()
+	if b.State() != BreakerOpen {
+		t.Fatal("failed probe should reopen the breaker")
+	}
+	time.Sleep(time.Millisecond * 60)
+	if err = b.allow(); err != nil {
+		t.Fatal("breaker should let a probe through after OpenTimeout", err)
+	}
+	b.succeed()
+	if b.State() != BreakerClosed || b.opens.Load() != 2 {
+		t.Fatal("successful probe should close the breaker", b.State(), b.opens.Load())
+	}
+	expected := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	changes := recorder.get()
+	if len(changes) != len(expected) {
+		t.Fatal("state changes mismatch", changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatal("state changes mismatch", changes)
+		}
+	}
+}
+
+func TestTaskSocketPool_CircuitBreaker_Connect(t *testing.T) {
+	addr := testHelper.DeadAddr(t)
+	factory := NewFactory(addr, time.Second, time.Second, time.Second)
+	pool := NewPool(1, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"), WithCircuitBreaker(BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Hour}))
+	defer pool.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := pool.GetContext(context.Background()); !errors.Is(err, contract.ErrGatewayDisconnected) {
+			t.Fatal("GetContext should return contract.ErrGatewayDisconnected", err)
+		}
+	}
+	if _, err := pool.GetContext(context.Background()); !errors.Is(err, contract.ErrCircuitOpen) {
+		t.Error("GetContext should return contract.ErrCircuitOpen", err)
+	}
+	if _, err := pool.GetPinnedContext(context.Background(), "key"); !errors.Is(err, contract.ErrCircuitOpen) {
+		t.Error("GetPinnedContext should return contract.ErrCircuitOpen", err)
+	}
+	if stats := pool.Stats(); stats.Breaker != BreakerOpen || stats.BreakerOpens != 1 || stats.ConnectFailures != 2 {
+		t.Error("stats of circuit breaker mismatch", stats.Breaker, stats.BreakerOpens, stats.ConnectFailures)
+	}
+}
+
+// roundTripForBreakerTest 借出一个socket，发送一个请求并等待响应
+func roundTripForBreakerTest(ctx context.Context, pool *Pool) error {
+	taskSocket, err := pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer taskSocket.Release()
+	req := socket.AcquireFrame()
+	defer req.Release()
+	req.Append([]byte("ping"))
+	resp := socket.AcquireFrame()
+	defer resp.Release()
+	return taskSocket.RoundTripContext(ctx, req, resp)
+}
+
+func TestTaskSocketPool_CircuitBreaker_Receive(t *testing.T) {
+	g := &toggleGateway{}
+	g.silent.Store(true)
+	recorder := &breakerRecorder{}
+	factory := NewFactory("pipe", time.Millisecond*20, time.Second, time.Second, socket.WithDialer(g.dial))
+	pool := NewPool(1, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"), WithCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Millisecond * 30, OnStateChange: recorder.record}))
+	defer pool.Close()
+	roundTrip := func() error {
+		return roundTripForBreakerTest(context.Background(), pool)
+	}
+	//网关不响应，借出期间接收超时
+	if err := roundTrip(); !errors.Is(err, contract.ErrGatewayTimeout) {
+		t.Fatal("RoundTripContext should time out", err)
+	}
+	if err := roundTrip(); !errors.Is(err, contract.ErrCircuitOpen) {
+		t.Fatal("GetContext should return contract.ErrCircuitOpen", err)
+	}
+	//网关恢复，试探的请求成功后关闭熔断器
+	g.silent.Store(false)
+	time.Sleep(time.Millisecond * 40)
+	if err := roundTrip(); err != nil {
+		t.Fatal("probe should succeed", err)
+	}
+	if pool.BreakerState() != BreakerClosed {
+		t.Error("successful probe should close the breaker", pool.BreakerState())
+	}
+	if changes := recorder.get(); len(changes) != 3 || changes[2] != BreakerClosed {
+		t.Error("state changes mismatch", changes)
+	}
+}
+
+func TestTaskSocketPool_CircuitBreaker_StaleRelease(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(2, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"), WithCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Hour}))
+	defer pool.Close()
+	borrowed, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	pool.breaker.fail()
+	if pool.BreakerState() != BreakerOpen {
+		t.Fatal("breaker should be open")
+	}
+	//打开前借出的socket没有收发失败，归还时不能关闭熔断器
+	borrowed.Release()
+	if pool.BreakerState() != BreakerOpen {
+		t.Error("stale release should not close an open breaker", pool.BreakerState())
+	}
+	if _, err = pool.GetContext(context.Background()); !errors.Is(err, contract.ErrCircuitOpen) {
+		t.Error("GetContext should return contract.ErrCircuitOpen", err)
+	}
+}
+
+func TestTaskSocketPool_CircuitBreaker_CallerTimeout(t *testing.T) {
+	g := &toggleGateway{}
+	g.silent.Store(true)
+	factory := NewFactory("pipe", time.Second, time.Second, time.Second, socket.WithDialer(g.dial))
+	pool := NewPool(1, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"), WithCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Hour}))
+	defer pool.Close()
+	//调用方的ctx先于读超时结束，不是网关的失败
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		err := roundTripForBreakerTest(ctx, pool)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("RoundTripContext should exceed the deadline", err)
+		}
+	}
+	if pool.BreakerState() != BreakerClosed {
+		t.Error("caller timeouts should not open the breaker", pool.BreakerState())
+	}
+}
+
+func TestTaskSocketPool_CircuitBreaker_Open_NoDial(t *testing.T) {
+	var dials atomic.Int32
+	g := &toggleGateway{}
+	factory := NewFactory("pipe", time.Second, time.Second, time.Second, socket.WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return g.dial(ctx, addr)
+	}))
+	var lost atomic.Int32
+	pool := NewPool(2, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"),
+		WithCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Hour}),
+		WithMinIdle(2),
+		WithAsyncWriter(AsyncWriterConfig{OnError: func(err error, frames int) {
+			if errors.Is(err, contract.ErrCircuitOpen) {
+				lost.Add(int32(frames))
+			}
+		}}))
+	defer pool.Close()
+	pool.breaker.fail()
+	pool.heartbeat()
+	if err := pool.AsyncWriter().Write(context.Background(), []byte("hello")); err != nil {
+		t.Fatal("Write failed", err)
+	}
+	if err := pool.AsyncWriter().Flush(context.Background()); !errors.Is(err, contract.ErrCircuitOpen) {
+		t.Error("Flush should return contract.ErrCircuitOpen", err)
+	}
+	if dials.Load() != 0 || lost.Load() != 1 {
+		t.Error("open breaker should stop dialing", dials.Load(), lost.Load())
+	}
+}
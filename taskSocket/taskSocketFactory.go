@@ -16,32 +16,63 @@
 
 package taskSocket
 
-import "time"
+import (
+	"context"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
+	"time"
+)
 
 type Factory struct {
 	addr           string
 	receiveTimeout time.Duration
 	sendTimeout    time.Duration
 	connectTimeout time.Duration
+	opts           []socket.Option
+	//工厂创建的所有socket共用计数器
+	oversize *socket.OversizeCounter
+	traffic  *socket.TrafficCounter
 }
 
-func NewFactory(addr string, receiveTimeout time.Duration, sendTimeout time.Duration, connectTimeout time.Duration) *Factory {
+// NewFactory 创建socket工厂，opts会作用于工厂创建的每个socket，例如socket.WithMaxFrameSize、socket.WithTLSConfig
+func NewFactory(addr string, receiveTimeout time.Duration, sendTimeout time.Duration, connectTimeout time.Duration, opts ...socket.Option) *Factory {
+	oversize := &socket.OversizeCounter{}
+	traffic := &socket.TrafficCounter{}
 	return &Factory{
 		addr:           addr,
 		receiveTimeout: receiveTimeout,
 		sendTimeout:    sendTimeout,
 		connectTimeout: connectTimeout,
+		opts:           append(opts[:len(opts):len(opts)], socket.WithOversizeCounter(oversize), socket.WithTrafficCounter(traffic)),
+		oversize:       oversize,
+		traffic:        traffic,
 	}
 }
 
 func (t *Factory) Make(pool *Pool) *TaskSocket {
-	socket := New(t.addr, t.receiveTimeout, t.sendTimeout, t.connectTimeout, pool)
-	if socket.Connect() {
-		return socket
+	socket, _ := t.MakeContext(context.Background(), pool)
+	return socket
+}
+
+// MakeContext 创建一个已经连接到网关的socket，ctx的截止时间与取消会作用于连接过程
+func (t *Factory) MakeContext(ctx context.Context, pool *Pool) (*TaskSocket, error) {
+	socket := New(t.addr, t.receiveTimeout, t.sendTimeout, t.connectTimeout, pool, t.opts...)
+	if err := socket.ConnectContext(ctx); err != nil {
+		return nil, err
 	}
-	return nil
+	socket.createdAt = time.Now()
+	return socket, nil
 }
 
 func (t *Factory) GetAddr() string {
 	return t.addr
 }
+
+// OversizeCounter 工厂创建的所有socket的超限数据帧的计数器
+func (t *Factory) OversizeCounter() *socket.OversizeCounter {
+	return t.oversize
+}
+
+// TrafficCounter 工厂创建的所有socket的收发字节数的计数器
+func (t *Factory) TrafficCounter() *socket.TrafficCounter {
+	return t.traffic
+}
@@ -0,0 +1,155 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
+	"github.com/buexplain/netsvr-protocol-go/v6/netsvrProtocol"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckConfig 健康检查的配置，参见WithHealthCheck
+type HealthCheckConfig struct {
+	//检查时发送的请求，网关必须对其返回一个响应，并且响应的cmd与请求的cmd一致，默认是不带参数的Cmd_UniqIdCount
+	Message []byte
+	//等待响应的时间，超时视为失败，默认是1秒
+	Timeout time.Duration
+	//借出前检查空闲时间超过该值的socket，小于等于0表示借出前不检查
+	TestOnBorrow time.Duration
+	//连续失败多少次后把池标记为不健康，连接网关失败也计入失败，默认是3
+	UnhealthyThreshold int
+}
+
+func (c *HealthCheckConfig) init() {
+	if len(c.Message) == 0 {
+		c.Message = binary.BigEndian.AppendUint32(nil, uint32(netsvrProtocol.Cmd_UniqIdCount))
+	} else {
+		c.Message = bytes.Clone(c.Message)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = time.Second
+	}
+	if c.UnhealthyThreshold <= 0 {
+		c.UnhealthyThreshold = 3
+	}
+}
+
+// poolHealth 池的健康状态
+type poolHealth struct {
+	unhealthy atomic.Bool
+	//连续失败的次数，任意一次检查成功后清零
+	failures atomic.Int64
+}
+
+func (h *poolHealth) fail(t *Pool) {
+	t.stats.healthCheckFailures.Add(1)
+	if h.failures.Add(1) >= int64(t.healthCheck.UnhealthyThreshold) && !h.unhealthy.Swap(true) {
+		log.Error("taskSocketPool " + t.GetAddr() + " marked unhealthy")
+	}
+}
+
+func (h *poolHealth) succeed(t *Pool) {
+	h.failures.Store(0)
+	if h.unhealthy.Swap(false) {
+		log.Info("taskSocketPool " + t.GetAddr() + " recovered")
+	}
+}
+
+// Healthy 池是否健康，没有开启健康检查时总是健康
+func (t *Pool) Healthy() bool {
+	return !t.health.unhealthy.Load()
+}
+
+// check 心跳时检查socket，没有开启健康检查时只发送心跳
+func (t *Pool) check(s *TaskSocket) bool {
+	if t.healthCheck == nil {
+		return s.Send(t.heartbeatMessage)
+	}
+	return t.probe(s)
+}
+
+// testOnBorrow 借出前检查空闲过久的socket，刚建立的socket不检查，检查失败时归还容量
+func (t *Pool) testOnBorrow(s *TaskSocket) bool {
+	if t.healthCheck == nil || t.healthCheck.TestOnBorrow <= 0 || s.idleAt.IsZero() || time.Since(s.idleAt) < t.healthCheck.TestOnBorrow {
+		return true
+	}
+	if t.probe(s) {
+		return true
+	}
+	log.Info("taskSocketPool " + t.GetAddr() + " socket failed test on borrow")
+	t.putIdle(nil)
+	return false
+}
+
+// probe 发送健康检查的请求，并在Timeout内等待网关的响应，失败时关闭socket
+func (t *Pool) probe(s *TaskSocket) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), t.healthCheck.Timeout)
+	defer cancel()
+	req := socket.AcquireFrame()
+	defer req.Release()
+	req.Append(t.healthCheck.Message)
+	resp := socket.AcquireFrame()
+	defer resp.Release()
+	var err error
+	if err = s.SendFrameContext(ctx, req); err == nil {
+		err = s.ReceiveFrameContext(ctx, resp)
+	}
+	//响应与请求不对应，说明连接上的数据已经错位，不能再使用
+	if err != nil || !bytes.HasPrefix(resp.Payload(), t.healthCheck.Message[:min(len(t.healthCheck.Message), 4)]) {
+		s.Close()
+		t.health.fail(t)
+		log.Info("taskSocketPool "+t.GetAddr()+" health check failed", "error", err)
+		return false
+	}
+	t.health.succeed(t)
+	return true
+}
+
+// revive 池不健康时建立一个新的连接进行检查，检查成功后池恢复健康，该连接放回池中
+// 熔断器打开时不建立连接，半开时本次检查作为试探的请求，检查的结果报告给熔断器
+func (t *Pool) revive() {
+	if t.allow() != nil {
+		return
+	}
+	select {
+	case <-t.size:
+	default:
+		return
+	}
+	s, err := t.dial(context.Background())
+	if err != nil {
+		t.size <- struct{}{}
+		return
+	}
+	if !t.probe(s) {
+		if t.breaker != nil {
+			t.breaker.fail()
+		}
+		t.putIdle(nil)
+		return
+	}
+	if t.breaker != nil {
+		t.breaker.succeed()
+	}
+	s.idleAt = time.Now()
+	t.putIdle(s)
+}
@@ -0,0 +1,131 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"context"
+	"errors"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// toggleGateway 通过net.Pipe模拟网关，silent为true时新建立的连接只接收不响应，否则原样返回收到的数据
+type toggleGateway struct {
+	silent atomic.Bool
+}
+
+func (g *toggleGateway) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if g.silent.Load() {
+		return testHelper.PipeDialer(testHelper.Discard)(ctx, addr)
+	}
+	return testHelper.PipeDialer(testHelper.Echo)(ctx, addr)
+}
+
+func makeHealthCheckPool(g *toggleGateway, config HealthCheckConfig) *Pool {
+	factory := NewFactory("pipe", time.Second, time.Second, time.Second, socket.WithDialer(g.dial))
+	return NewPool(2, factory, time.Millisecond*50, time.Hour, []byte("~6YOt5rW35piO~"), WithHealthCheck(config))
+}
+
+func TestTaskSocketPool_HealthCheck_Unhealthy(t *testing.T) {
+	g := &toggleGateway{}
+	g.silent.Store(true)
+	pool := makeHealthCheckPool(g, HealthCheckConfig{Timeout: time.Millisecond * 50, UnhealthyThreshold: 1})
+	defer pool.Close()
+	taskSocket, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	taskSocket.Release()
+	//网关不响应健康检查的请求
+	pool.heartbeat()
+	if pool.Healthy() || len(pool.pool) != 0 || len(pool.size) != 2 {
+		t.Fatal("pool should be unhealthy and evict the socket", pool.Healthy(), len(pool.pool), len(pool.size))
+	}
+	start := time.Now()
+	if _, err = pool.GetContext(context.Background()); !errors.Is(err, contract.ErrGatewayUnhealthy) {
+		t.Error("GetContext should return contract.ErrGatewayUnhealthy", err)
+	}
+	if _, err = pool.GetPinnedContext(context.Background(), "key"); !errors.Is(err, contract.ErrGatewayUnhealthy) {
+		t.Error("GetPinnedContext should return contract.ErrGatewayUnhealthy", err)
+	}
+	if time.Since(start) > time.Millisecond*20 {
+		t.Error("unhealthy pool should fail fast")
+	}
+	//空闲socket的检查失败一次，同一次心跳中尝试恢复又失败一次
+	if stats := pool.Stats(); stats.Healthy || stats.HealthCheckFailures != 2 {
+		t.Error("stats of health check mismatch", stats.Healthy, stats.HealthCheckFailures)
+	}
+	//网关恢复后，心跳时的检查让池恢复健康
+	g.silent.Store(false)
+	pool.heartbeat()
+	if !pool.Healthy() || len(pool.pool) != 1 {
+		t.Fatal("pool should recover", pool.Healthy(), len(pool.pool))
+	}
+	if taskSocket, err = pool.GetContext(context.Background()); err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	taskSocket.Release()
+}
+
+func TestTaskSocketPool_HealthCheck_Threshold(t *testing.T) {
+	g := &toggleGateway{}
+	g.silent.Store(true)
+	pool := makeHealthCheckPool(g, HealthCheckConfig{Timeout: time.Millisecond * 20, UnhealthyThreshold: 2})
+	defer pool.Close()
+	for i := 0; i < 2; i++ {
+		taskSocket, err := pool.GetContext(context.Background())
+		if err != nil {
+			t.Fatal("GetContext failed", err)
+		}
+		taskSocket.Release()
+		pool.heartbeat()
+		if pool.Healthy() != (i == 0) {
+			t.Fatal("pool should be unhealthy after 2 consecutive failures", i)
+		}
+	}
+}
+
+func TestTaskSocketPool_HealthCheck_TestOnBorrow(t *testing.T) {
+	g := &toggleGateway{}
+	g.silent.Store(true)
+	pool := makeHealthCheckPool(g, HealthCheckConfig{Timeout: time.Millisecond * 20, TestOnBorrow: time.Millisecond * 10, UnhealthyThreshold: 2})
+	defer pool.Close()
+	taskSocket, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	taskSocket.Release()
+	time.Sleep(time.Millisecond * 20)
+	//空闲的socket检查失败后被关闭，重新建立的socket不需要检查
+	g.silent.Store(false)
+	borrowed, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	defer borrowed.Release()
+	if borrowed == taskSocket || !borrowed.IsConnected() {
+		t.Error("GetContext should replace the broken socket")
+	}
+	if stats := pool.Stats(); stats.Created != 2 || stats.HealthCheckFailures != 1 || stats.InUse != 1 || !stats.Healthy {
+		t.Error("stats mismatch", stats)
+	}
+}
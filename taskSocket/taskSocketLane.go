@@ -0,0 +1,118 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"context"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"hash/maphash"
+	"time"
+)
+
+// lane 有序通道，同一时刻只能被一个调用方持有，经过同一个通道的数据总是写入同一个连接，网关会按写入的顺序处理
+type lane struct {
+	//空闲时有一个令牌，持有令牌即持有通道
+	token  chan struct{}
+	socket *TaskSocket
+}
+
+func newLane() *lane {
+	tmp := &lane{token: make(chan struct{}, 1)}
+	tmp.token <- struct{}{}
+	return tmp
+}
+
+// GetPinnedContext 按key获取有序通道的socket，key相同的调用总是拿到同一个连接，并且同一时刻只有一个调用方持有，用完后需要Release
+// 连接断开后，下一次获取时会重新连接，ctx的截止时间与取消会作用于等待与连接过程
+func (t *Pool) GetPinnedContext(ctx context.Context, key string) (*TaskSocket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if t.isClosed() {
+		return nil, contract.ErrPoolClosed
+	}
+	if !t.Healthy() {
+		return nil, contract.ErrGatewayUnhealthy
+	}
+	if t.breaker != nil {
+		if err := t.breaker.allow(); err != nil {
+			return nil, err
+		}
+	}
+	l := t.lanes[0]
+	if len(t.lanes) > 1 {
+		l = t.lanes[maphash.String(t.laneSeed, key)%uint64(len(t.lanes))]
+	}
+	//waitTimeout为0时，一直等待，直到ctx结束
+	var timeout <-chan time.Time
+	if t.waitTimeout > 0 {
+		timer := time.NewTimer(t.waitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-l.token:
+	case <-timeout:
+		t.stats.waitTimeouts.Add(1)
+		return nil, contract.ErrPoolExhausted
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.closedCh:
+		return nil, contract.ErrPoolClosed
+	}
+	if t.isClosed() {
+		t.releaseLane(l)
+		return nil, contract.ErrPoolClosed
+	}
+	if l.socket == nil || !l.socket.IsConnected() {
+		socket, err := t.dial(ctx)
+		if err != nil {
+			log.Error("taskSocketPool "+t.factory.GetAddr()+" new pinned socket failed", "error", err)
+			l.token <- struct{}{}
+			return nil, err
+		}
+		socket.lane = l
+		l.socket = socket
+	}
+	if !t.borrow(l.socket) {
+		t.releaseLane(l)
+		return nil, contract.ErrPoolClosed
+	}
+	l.socket.failures = l.socket.Failures()
+	return l.socket, nil
+}
+
+// releaseLane 归还有序通道，池已经关闭则关闭通道的连接
+func (t *Pool) releaseLane(l *lane) {
+	if t.isClosed() && l.socket != nil {
+		l.socket.Close()
+	}
+	l.token <- struct{}{}
+}
+
+// eachIdleLane 对当前没有被持有的有序通道执行fn
+func (t *Pool) eachIdleLane(fn func(l *lane)) {
+	for _, l := range t.lanes {
+		select {
+		case <-l.token:
+			fn(l)
+			l.token <- struct{}{}
+		default:
+		}
+	}
+}
@@ -0,0 +1,66 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"context"
+	"errors"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"testing"
+	"time"
+)
+
+func TestTaskSocketPool_GetPinnedContext(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second*10, time.Second*10, time.Second*10)
+	pool := NewPool(1, factory, time.Millisecond*50, time.Second*10, []byte("~6YOt5rW35piO~"), WithLanes(4))
+	first, err := pool.GetPinnedContext(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//有序通道被持有时，相同的key需要等待
+	if _, err = pool.GetPinnedContext(context.Background(), "a"); !errors.Is(err, contract.ErrPoolExhausted) {
+		t.Error("GetPinnedContext should wait for the lane", err)
+	}
+	//有序通道不占用池的容量
+	socket, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if socket == first {
+		t.Error("pinned socket should not come from the pool")
+	}
+	socket.Release()
+	first.Release()
+	second, err := pool.GetPinnedContext(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Error("the same key should get the same connection")
+	}
+	second.Release()
+	//关闭池会关闭空闲的有序通道
+	pool.Close()
+	if first.IsConnected() {
+		t.Error("Close should close the pinned socket")
+	}
+	if _, err = pool.GetPinnedContext(context.Background(), "a"); !errors.Is(err, contract.ErrPoolClosed) {
+		t.Error("GetPinnedContext should return contract.ErrPoolClosed", err)
+	}
+}
@@ -0,0 +1,110 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"context"
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// LeakDetectionConfig 泄漏检测的配置，参见WithLeakDetection
+type LeakDetectionConfig struct {
+	//借出超过该时间仍未归还的socket视为泄漏，默认是1分钟
+	Threshold time.Duration
+	//发现泄漏时的回调，每个socket每次借出只报告一次，在心跳协程中执行，为nil时只打印日志
+	OnLeak func(addr string, borrowed BorrowedSocket)
+}
+
+// BorrowedSocket 借出的socket的快照
+type BorrowedSocket struct {
+	//借出的时间
+	BorrowedAt time.Time
+	//借出时的调用栈，没有开启泄漏检测时为空
+	Stack string
+	//是否是有序通道的socket
+	Pinned bool
+}
+
+// borrowRecord 借出的记录
+type borrowRecord struct {
+	at    time.Time
+	stack []byte
+	//是否已经报告过泄漏
+	reported bool
+}
+
+// Borrowed 当前借出尚未归还的socket，按借出的时间排序
+func (t *Pool) Borrowed() []BorrowedSocket {
+	t.borrowedMux.Lock()
+	ret := make([]BorrowedSocket, 0, len(t.borrowed))
+	for socket, record := range t.borrowed {
+		ret = append(ret, BorrowedSocket{BorrowedAt: record.at, Stack: string(record.stack), Pinned: socket.lane != nil})
+	}
+	t.borrowedMux.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].BorrowedAt.Before(ret[j].BorrowedAt)
+	})
+	return ret
+}
+
+// detectLeaks 报告借出超过阈值仍未归还的socket
+func (t *Pool) detectLeaks(now time.Time) {
+	threshold := t.leakDetection.Threshold
+	if threshold <= 0 {
+		threshold = time.Minute
+	}
+	var leaks []BorrowedSocket
+	t.borrowedMux.Lock()
+	for socket, record := range t.borrowed {
+		if record.reported || now.Sub(record.at) < threshold {
+			continue
+		}
+		record.reported = true
+		t.borrowed[socket] = record
+		leaks = append(leaks, BorrowedSocket{BorrowedAt: record.at, Stack: string(record.stack), Pinned: socket.lane != nil})
+	}
+	t.borrowedMux.Unlock()
+	for _, leak := range leaks {
+		log.Error("taskSocketPool "+t.GetAddr()+" socket not released", "held", now.Sub(leak.BorrowedAt), "stack", leak.Stack)
+		if t.leakDetection.OnLeak != nil {
+			t.onLeak(leak)
+		}
+	}
+}
+
+// onLeak 执行泄漏的回调，回调的panic不会影响心跳
+func (t *Pool) onLeak(leak BorrowedSocket) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("taskSocketPool leak detection hook panic", "err", err, "stack", debug.Stack())
+		}
+	}()
+	t.leakDetection.OnLeak(t.GetAddr(), leak)
+}
+
+// With 从池中获取一个socket并执行fn，fn返回或者panic后总是归还socket，获取失败时不执行fn并返回错误
+func (t *Pool) With(ctx context.Context, fn func(socket *TaskSocket) error) error {
+	socket, err := t.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer socket.Release()
+	return fn(socket)
+}
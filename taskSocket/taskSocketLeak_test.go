@@ -0,0 +1,130 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"context"
+	"errors"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTaskSocketPool_Borrowed(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(2, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"))
+	defer pool.Close()
+	borrowed, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	pinned, err := pool.GetPinnedContext(context.Background(), "key")
+	if err != nil {
+		t.Fatal("GetPinnedContext failed", err)
+	}
+	list := pool.Borrowed()
+	if len(list) != 2 || list[0].Pinned || !list[1].Pinned || list[0].BorrowedAt.After(list[1].BorrowedAt) {
+		t.Fatal("Borrowed mismatch", list)
+	}
+	//没有开启泄漏检测，不记录调用栈
+	if list[0].Stack != "" {
+		t.Error("Borrowed should not record stack without leak detection")
+	}
+	borrowed.Release()
+	pinned.Release()
+	if len(pool.Borrowed()) != 0 {
+		t.Error("released sockets should not be listed")
+	}
+}
+
+func TestTaskSocketPool_LeakDetection(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	mux := sync.Mutex{}
+	var leaks []BorrowedSocket
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(2, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"), WithLeakDetection(LeakDetectionConfig{
+		Threshold: time.Millisecond * 20,
+		OnLeak: func(addr string, borrowed BorrowedSocket) {
+			mux.Lock()
+			defer mux.Unlock()
+			leaks = append(leaks, borrowed)
+		},
+	}))
+	defer pool.Close()
+	borrowed, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	defer borrowed.Release()
+	if list := pool.Borrowed(); len(list) != 1 || !strings.Contains(list[0].Stack, "TestTaskSocketPool_LeakDetection") {
+		t.Fatal("Borrowed should record the borrow stack", list)
+	}
+	pool.heartbeat()
+	mux.Lock()
+	if len(leaks) != 0 {
+		t.Error("socket held below the threshold should not be reported")
+	}
+	mux.Unlock()
+	time.Sleep(time.Millisecond * 30)
+	//每次借出只报告一次
+	pool.heartbeat()
+	pool.heartbeat()
+	mux.Lock()
+	defer mux.Unlock()
+	if len(leaks) != 1 || !strings.Contains(leaks[0].Stack, "TestTaskSocketPool_LeakDetection") {
+		t.Error("leaked socket should be reported once with the borrow stack", len(leaks))
+	}
+}
+
+func TestTaskSocketPool_With(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(1, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"))
+	fnErr := errors.New("fn failed")
+	if err := pool.With(context.Background(), func(socket *TaskSocket) error {
+		if !socket.IsConnected() {
+			t.Error("With should pass a connected socket")
+		}
+		return fnErr
+	}); !errors.Is(err, fnErr) {
+		t.Error("With should return the error of fn", err)
+	}
+	//fn发生panic，socket同样会被归还
+	func() {
+		defer func() {
+			_ = recover()
+		}()
+		_ = pool.With(context.Background(), func(socket *TaskSocket) error {
+			panic("fn panic")
+		})
+	}()
+	if len(pool.Borrowed()) != 0 || len(pool.pool) != 1 {
+		t.Error("With should always release the socket", len(pool.Borrowed()), len(pool.pool))
+	}
+	pool.Close()
+	called := false
+	if err := pool.With(context.Background(), func(socket *TaskSocket) error {
+		called = true
+		return nil
+	}); !errors.Is(err, contract.ErrPoolClosed) || called {
+		t.Error("With should not call fn when GetContext failed", err)
+	}
+}
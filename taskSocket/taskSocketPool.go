@@ -17,7 +17,12 @@
 package taskSocket
 
 import (
+	"context"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
 	"github.com/buexplain/netsvr-business-go/v2/log"
+	"hash/maphash"
+	"runtime/debug"
+	"sync"
 	"time"
 )
 
@@ -29,9 +34,35 @@ type Pool struct {
 	heartbeatInterval time.Duration
 	heartbeatMessage  []byte
 	closedCh          chan struct{}
+	closeOnce         sync.Once
+	//有序通道
+	lanes    []*lane
+	laneSeed maphash.Seed
+	//异步写入器，没有配置时为nil
+	asyncWriterConfig *AsyncWriterConfig
+	asyncWriter       *AsyncWriter
+	//空闲连接的管理，由LoopHeartbeat驱动
+	minIdle     int
+	maxIdleTime time.Duration
+	maxLifetime time.Duration
+	stats       poolStats
+	//健康检查，没有配置时为nil
+	healthCheck *HealthCheckConfig
+	health      poolHealth
+	//熔断器，没有配置时为nil
+	breakerConfig *BreakerConfig
+	breaker       *breaker
+	//借出的socket，包括有序通道的socket，用于CloseContext等待归还
+	borrowedMux sync.Mutex
+	borrowed    map[*TaskSocket]borrowRecord
+	//泄漏检测，没有配置时为nil
+	leakDetection *LeakDetectionConfig
+	//池关闭并且借出的socket全部归还后close
+	returnedCh   chan struct{}
+	returnedOnce sync.Once
 }
 
-func NewPool(size int, factory *Factory, waitTimeout time.Duration, heartbeatInterval time.Duration, heartbeatMessage []byte) *Pool {
+func NewPool(size int, factory *Factory, waitTimeout time.Duration, heartbeatInterval time.Duration, heartbeatMessage []byte, opts ...PoolOption) *Pool {
 	tmp := &Pool{}
 	tmp.factory = factory
 	tmp.waitTimeout = waitTimeout
@@ -39,75 +70,276 @@ func NewPool(size int, factory *Factory, waitTimeout time.Duration, heartbeatInt
 	tmp.heartbeatMessage = make([]byte, len(heartbeatMessage))
 	copy(tmp.heartbeatMessage, heartbeatMessage)
 	tmp.closedCh = make(chan struct{})
+	tmp.borrowed = make(map[*TaskSocket]borrowRecord)
+	tmp.returnedCh = make(chan struct{})
 	tmp.pool = make(chan *TaskSocket, size)
 	tmp.size = make(chan struct{}, size)
 	for i := 0; i < size; i++ {
 		tmp.size <- struct{}{}
 	}
+	tmp.lanes = make([]*lane, 1)
+	tmp.laneSeed = maphash.MakeSeed()
+	for _, opt := range opts {
+		opt(tmp)
+	}
+	for i := range tmp.lanes {
+		tmp.lanes[i] = newLane()
+	}
+	if tmp.healthCheck != nil {
+		tmp.healthCheck.init()
+	}
+	if tmp.breakerConfig != nil {
+		tmp.breaker = newBreaker(factory.GetAddr(), *tmp.breakerConfig)
+	}
+	if tmp.asyncWriterConfig != nil {
+		tmp.asyncWriter = newAsyncWriter(tmp, *tmp.asyncWriterConfig)
+	}
 	return tmp
 }
 
+// AsyncWriter 返回池的异步写入器，没有通过WithAsyncWriter配置时返回nil
+func (t *Pool) AsyncWriter() *AsyncWriter {
+	return t.asyncWriter
+}
+
 func (t *Pool) GetAddr() string {
 	return t.factory.GetAddr()
 }
 
 func (t *Pool) Get() *TaskSocket {
+	socket, _ := t.GetContext(context.Background())
+	return socket
+}
+
+// GetContext 从池中获取一个socket，ctx的截止时间与取消会作用于等待与连接过程
+// 开启了健康检查时，池不健康则立即返回contract.ErrGatewayUnhealthy，空闲过久的socket在借出前会被检查，检查失败的socket被关闭后重新获取
+func (t *Pool) GetContext(ctx context.Context) (*TaskSocket, error) {
+	for {
+		socket, err := t.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !t.testOnBorrow(socket) {
+			continue
+		}
+		if !t.borrow(socket) {
+			socket.Close()
+			t.putIdle(nil)
+			return nil, contract.ErrPoolClosed
+		}
+		socket.failures = socket.Failures()
+		return socket, nil
+	}
+}
+
+func (t *Pool) get(ctx context.Context) (*TaskSocket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if t.isClosed() {
+		return nil, contract.ErrPoolClosed
+	}
+	if !t.Healthy() {
+		return nil, contract.ErrGatewayUnhealthy
+	}
+	if err := t.allow(); err != nil {
+		return nil, err
+	}
 	if len(t.pool) == 0 {
 		select {
 		case <-t.size:
-			socket := t.factory.Make(t)
-			if socket == nil || socket.IsConnected() == false {
-				log.Error("taskSocketPool " + t.factory.GetAddr() + " new socket failed")
+			socket, err := t.dial(ctx)
+			if err != nil {
+				log.Error("taskSocketPool "+t.factory.GetAddr()+" new socket failed", "error", err)
 				t.size <- struct{}{}
-				return nil
-			} else {
-				log.Info("taskSocketPool " + t.factory.GetAddr() + " new socket success")
-				return socket
+				return nil, err
+			}
+			//连接期间池被关闭
+			if t.isClosed() {
+				socket.Close()
+				t.size <- struct{}{}
+				return nil, contract.ErrPoolClosed
 			}
+			log.Info("taskSocketPool " + t.factory.GetAddr() + " new socket success")
+			return socket, nil
 		default:
-			goto wait
 		}
 	}
-wait:
-	if t.waitTimeout == 0 {
-		return <-t.pool
+	select {
+	case socket := <-t.pool:
+		return socket, nil
+	default:
+	}
+	t.stats.waits.Add(1)
+	//waitTimeout为0时，一直等待，直到ctx结束
+	var timeout <-chan time.Time
+	if t.waitTimeout > 0 {
+		timer := time.NewTimer(t.waitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
-	timeout := time.NewTimer(t.waitTimeout)
-	defer timeout.Stop()
 	select {
 	case socket := <-t.pool:
-		return socket
-	case <-timeout.C:
+		return socket, nil
+	case <-timeout:
+		t.stats.waitTimeouts.Add(1)
 		log.Error("Pool pool exhausted. Cannot establish new connection before wait_timeout.")
-		return nil
+		return nil, contract.ErrPoolExhausted
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.closedCh:
+		return nil, contract.ErrPoolClosed
 	}
 }
 
+// dial 建立一个属于池的socket，并记录连接的成功与失败次数
+func (t *Pool) dial(ctx context.Context) (*TaskSocket, error) {
+	socket, err := t.factory.MakeContext(ctx, t)
+	if err != nil {
+		t.stats.connectFailures.Add(1)
+		if t.healthCheck != nil {
+			t.health.fail(t)
+		}
+		if t.breaker != nil {
+			t.breaker.fail()
+		}
+		return nil, err
+	}
+	t.stats.created.Add(1)
+	return socket, nil
+}
+
 func (t *Pool) release(socket *TaskSocket) {
+	if socket != nil && t.expired(socket, time.Now()) {
+		socket.Close()
+		log.Info("taskSocketPool " + t.GetAddr() + " socket reached max lifetime")
+	}
+	if socket != nil {
+		socket.idleAt = time.Now()
+	}
+	t.putIdle(socket)
+}
+
+// putIdle 把socket放回池中，不更新空闲的起始时间，socket为nil或者已经断开时只归还容量
+func (t *Pool) putIdle(socket *TaskSocket) {
 	if socket == nil || !socket.IsConnected() {
 		t.size <- struct{}{}
 		return
 	}
+	//池已经关闭，直接关闭socket
+	if t.isClosed() {
+		socket.Close()
+		t.size <- struct{}{}
+		return
+	}
 	t.pool <- socket
+	//归还的同时池被关闭，由归还者负责清理
+	if t.isClosed() {
+		t.drain()
+	}
+}
+
+func (t *Pool) isClosed() bool {
+	select {
+	case <-t.closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain 关闭池中所有空闲的socket
+func (t *Pool) drain() {
+	for {
+		select {
+		case socket := <-t.pool:
+			socket.Close()
+			t.size <- struct{}{}
+		default:
+			return
+		}
+	}
+}
+
+// expired socket是否超过了最大存活时间
+func (t *Pool) expired(socket *TaskSocket, now time.Time) bool {
+	return t.maxLifetime > 0 && now.Sub(socket.createdAt) >= t.maxLifetime
 }
 
 func (t *Pool) heartbeat() {
-	for i := len(t.pool); i > 0; i-- {
+	now := time.Now()
+	idle := len(t.pool)
+	for i := idle; i > 0; i-- {
 		select {
 		case <-t.closedCh:
 			return
 		case socket := <-t.pool:
-			if socket.IsConnected() && socket.Send(t.heartbeatMessage) {
-				t.pool <- socket
+			if t.expired(socket, now) {
+				socket.Close()
+				log.Info("taskSocketPool heartbeat " + t.GetAddr() + " socket reached max lifetime")
+				idle--
+				t.putIdle(nil)
+			} else if t.maxIdleTime > 0 && idle > t.minIdle && now.Sub(socket.idleAt) >= t.maxIdleTime {
+				socket.Close()
+				log.Info("taskSocketPool heartbeat " + t.GetAddr() + " socket reached max idle time")
+				idle--
+				t.putIdle(nil)
+			} else if socket.IsConnected() && t.check(socket) {
+				t.putIdle(socket)
 			} else {
+				t.stats.heartbeatFailures.Add(1)
 				socket.Close()
 				log.Info("taskSocketPool heartbeat " + t.GetAddr() + " socket closed")
-				t.release(nil)
+				idle--
+				t.putIdle(nil)
 			}
 		default:
 			continue
 		}
 	}
+	t.eachIdleLane(func(l *lane) {
+		if l.socket == nil || !l.socket.IsConnected() {
+			return
+		}
+		if t.expired(l.socket, now) {
+			//下一次获取通道时重新连接
+			l.socket.Close()
+			log.Info("taskSocketPool heartbeat " + t.GetAddr() + " pinned socket reached max lifetime")
+		} else if !t.check(l.socket) {
+			t.stats.heartbeatFailures.Add(1)
+			l.socket.Close()
+			log.Info("taskSocketPool heartbeat " + t.GetAddr() + " pinned socket closed")
+		}
+	})
+	if !t.Healthy() {
+		t.revive()
+	}
+	t.fill()
+	if t.leakDetection != nil {
+		t.detectLeaks(now)
+	}
+	if t.asyncWriter != nil {
+		t.asyncWriter.heartbeat()
+	}
+}
+
+// fill 建立连接，直到池中的空闲socket达到minIdle，或者池的容量用完，熔断器没有关闭时不建立连接，避免占用试探的请求
+func (t *Pool) fill() {
+	for len(t.pool) < t.minIdle && !t.isClosed() && t.Healthy() && t.BreakerState() == BreakerClosed {
+		select {
+		case <-t.size:
+		default:
+			return
+		}
+		socket, err := t.dial(context.Background())
+		if err != nil {
+			log.Error("taskSocketPool "+t.factory.GetAddr()+" warm up socket failed", "error", err)
+			t.size <- struct{}{}
+			return
+		}
+		socket.idleAt = time.Now()
+		t.putIdle(socket)
+	}
 }
 
 func (t *Pool) LoopHeartbeat() {
@@ -119,6 +351,8 @@ func (t *Pool) LoopHeartbeat() {
 				log.Info("taskSocketPool loopHeartbeat " + t.GetAddr() + " quit")
 			}
 		}()
+		//预先建立连接，避免启动后的第一批请求承担连接的耗时
+		t.fill()
 		ticker := time.NewTicker(t.heartbeatInterval)
 		defer ticker.Stop()
 		for {
@@ -132,20 +366,79 @@ func (t *Pool) LoopHeartbeat() {
 	}()
 }
 
-func (t *Pool) Close() {
+// borrow 登记借出的socket，池已经关闭时返回false
+func (t *Pool) borrow(socket *TaskSocket) bool {
+	t.borrowedMux.Lock()
+	defer t.borrowedMux.Unlock()
+	if t.isClosed() {
+		return false
+	}
+	record := borrowRecord{at: time.Now()}
+	if t.leakDetection != nil {
+		record.stack = debug.Stack()
+	}
+	t.borrowed[socket] = record
+	return true
+}
+
+// giveBack 注销归还的socket
+func (t *Pool) giveBack(socket *TaskSocket) {
+	t.borrowedMux.Lock()
+	delete(t.borrowed, socket)
+	t.borrowedMux.Unlock()
+	t.checkReturned()
+}
+
+// checkReturned 池已经关闭并且借出的socket全部归还时，通知CloseContext
+func (t *Pool) checkReturned() {
+	t.borrowedMux.Lock()
+	done := len(t.borrowed) == 0 && t.isClosed()
+	t.borrowedMux.Unlock()
+	if done {
+		t.returnedOnce.Do(func() {
+			close(t.returnedCh)
+		})
+	}
+}
+
+// CloseContext 关闭池，不再借出socket，空闲的socket被立即关闭，然后等待借出的socket归还，归还的socket会被关闭
+// ctx结束时仍未归还的socket会被强制关闭，并返回ctx.Err()，这些socket之后仍然需要Release
+// 异步写入器写入剩余数据的过程同样受ctx的限制
+func (t *Pool) CloseContext(ctx context.Context) error {
+	err := t.close(ctx)
+	t.checkReturned()
 	select {
-	case <-t.closedCh:
-		return
-	default:
+	case <-t.returnedCh:
+		return err
+	case <-ctx.Done():
+	}
+	t.borrowedMux.Lock()
+	for socket := range t.borrowed {
+		socket.Close()
+	}
+	t.borrowedMux.Unlock()
+	log.Error("taskSocketPool "+t.GetAddr()+" closed before all sockets returned", "error", ctx.Err())
+	return ctx.Err()
+}
+
+// Close 关闭池，空闲的socket会被立即关闭，借出的socket在归还时关闭，不等待借出的socket归还，参见CloseContext
+func (t *Pool) Close() {
+	_ = t.close(context.Background())
+}
+
+// close 关闭池，ctx限制异步写入器写入剩余数据的时间，ctx结束时异步写入器还没有写完则返回ctx.Err()
+func (t *Pool) close(ctx context.Context) (err error) {
+	t.closeOnce.Do(func() {
 		close(t.closedCh)
-		for i := 0; i < cap(t.size); i++ {
-			select {
-			case socket := <-t.pool:
-				socket.Close()
-				t.release(nil)
-			default:
-				continue
+		t.drain()
+		t.eachIdleLane(func(l *lane) {
+			if l.socket != nil {
+				l.socket.Close()
 			}
+		})
+		if t.asyncWriter != nil {
+			err = t.asyncWriter.CloseContext(ctx)
 		}
-	}
+	})
+	return err
 }
@@ -16,54 +16,317 @@
 
 package taskSocket
 
-import "github.com/buexplain/netsvr-business-go/v2/contract"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/log"
+	"sort"
+	"sync"
+)
 
 type Manger struct {
 	pools map[string]*Pool
+	mux   sync.RWMutex
+	//解析网关地址中的主机名，为nil时使用net.DefaultResolver
+	resolver contract.Resolver
 }
 
-func NewManger() *Manger {
-	return &Manger{
+func NewManger(opts ...MangerOption) *Manger {
+	tmp := &Manger{
 		pools: make(map[string]*Pool),
 	}
+	for _, opt := range opts {
+		opt(tmp)
+	}
+	return tmp
 }
 
 func (t *Manger) Close() {
+	t.mux.Lock()
 	pools := t.pools
 	t.pools = make(map[string]*Pool)
+	t.mux.Unlock()
 	for _, pool := range pools {
 		pool.Close()
 	}
 }
 
+// CloseContext 关闭所有网关的池，并发的等待各个池借出的socket归还，参见Pool.CloseContext
+func (t *Manger) CloseContext(ctx context.Context) error {
+	t.mux.Lock()
+	pools := t.pools
+	t.pools = make(map[string]*Pool)
+	t.mux.Unlock()
+	errs := make([]error, len(pools))
+	wg := sync.WaitGroup{}
+	i := 0
+	for _, pool := range pools {
+		wg.Add(1)
+		go func(i int, pool *Pool) {
+			defer wg.Done()
+			if err := pool.CloseContext(ctx); err != nil {
+				errs[i] = &contract.GatewayError{Addr: pool.GetAddr(), Err: err}
+			}
+		}(i, pool)
+		i++
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
 func (t *Manger) AddSocket(taskSocketPool *Pool) {
-	t.pools[contract.AddrConvertToHex(taskSocketPool.GetAddr())] = taskSocketPool
+	addrAsHex := t.resolve(taskSocketPool.GetAddr())
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.pools[addrAsHex] = taskSocketPool
+}
+
+// AddGateway 运行期间动态添加一个网关的池，网关已经存在则返回false
+func (t *Manger) AddGateway(taskSocketPool *Pool) bool {
+	addrAsHex := t.resolve(taskSocketPool.GetAddr())
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if _, ok := t.pools[addrAsHex]; ok {
+		return false
+	}
+	t.pools[addrAsHex] = taskSocketPool
+	return true
+}
+
+// RemoveGateway 运行期间动态移除一个网关，并关闭它的池，借出的socket会在归还时关闭，网关不存在则返回false
+func (t *Manger) RemoveGateway(addr string) bool {
+	t.mux.Lock()
+	addrAsHex, ok := t.lookup(addr)
+	if !ok {
+		t.mux.Unlock()
+		return false
+	}
+	pool := t.pools[addrAsHex]
+	delete(t.pools, addrAsHex)
+	t.mux.Unlock()
+	pool.Close()
+	return true
+}
+
+// AddrAsHex 返回网关地址对应的16进制字符串，即GetSocketContext等方法的addrAsHex参数，网关不存在时返回解析后的结果
+func (t *Manger) AddrAsHex(addr string) string {
+	t.mux.RLock()
+	addrAsHex, ok := t.lookup(addr)
+	t.mux.RUnlock()
+	if ok {
+		return addrAsHex
+	}
+	return t.resolve(addr)
+}
+
+// resolve 解析网关地址，失败时退化为contract.AddrConvertToHex，此时无法按uniqId路由到该网关
+func (t *Manger) resolve(addr string) string {
+	addrAsHex, err := contract.ResolveAddrAsHex(context.Background(), t.resolver, addr)
+	if err != nil {
+		log.Error("taskSocketPoolManger resolve "+addr+" failed", "error", err)
+		return contract.AddrConvertToHex(addr)
+	}
+	return addrAsHex
+}
+
+// lookup 按添加时的网关地址查找，而不是重新解析，避免主机名的解析结果变化后找不到网关，调用方需要持有锁
+func (t *Manger) lookup(addr string) (string, bool) {
+	for addrAsHex, pool := range t.pools {
+		if pool.GetAddr() == addr {
+			return addrAsHex, true
+		}
+	}
+	//写法不同的同一个ip地址
+	addrAsHex := contract.AddrConvertToHex(addr)
+	_, ok := t.pools[addrAsHex]
+	return addrAsHex, ok
+}
+
+// HasGateway 是否配置了addrAsHex对应的网关
+func (t *Manger) HasGateway(addrAsHex string) bool {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	_, ok := t.pools[addrAsHex]
+	return ok
 }
 
 func (t *Manger) Count() int {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
 	return len(t.pools)
 }
 
+// GetAddrsAsHex 获取所有网关地址的16进制字符串
+func (t *Manger) GetAddrsAsHex() []string {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	ret := make([]string, 0, len(t.pools))
+	for addrAsHex := range t.pools {
+		ret = append(ret, addrAsHex)
+	}
+	return ret
+}
+
+// GetAddrs 获取所有网关地址的快照，key是网关地址的16进制字符串，value是添加网关时的地址
+func (t *Manger) GetAddrs() map[string]string {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	ret := make(map[string]string, len(t.pools))
+	for addrAsHex, pool := range t.pools {
+		ret[addrAsHex] = pool.GetAddr()
+	}
+	return ret
+}
+
 func (t *Manger) GetSockets() []*TaskSocket {
-	ret := make([]*TaskSocket, 0, len(t.pools))
-	for _, pool := range t.pools {
-		socket := pool.Get()
-		if socket == nil {
+	ret, _ := t.GetSocketsContext(context.Background())
+	return ret
+}
+
+// GetSocketsContext 从每个网关的池中各获取一个socket，任意一个获取失败，则归还已获取的socket并返回错误
+func (t *Manger) GetSocketsContext(ctx context.Context) ([]*TaskSocket, error) {
+	return getSockets(t.getPools(), func(pool *Pool) (*TaskSocket, error) {
+		return pool.GetContext(ctx)
+	})
+}
+
+// GetAvailableSocketsContext 从每个网关的池中各获取一个socket，获取失败的网关会被跳过，并通过*contract.PartialError返回，全部成功时error为nil
+func (t *Manger) GetAvailableSocketsContext(ctx context.Context) ([]*TaskSocket, error) {
+	return getAvailableSockets(t.getPools(), func(pool *Pool) (*TaskSocket, error) {
+		return pool.GetContext(ctx)
+	})
+}
+
+// GetPinnedSocketsContext 从每个网关各获取一个key对应的有序通道的socket，任意一个获取失败，则归还已获取的socket并返回错误
+func (t *Manger) GetPinnedSocketsContext(ctx context.Context, key string) ([]*TaskSocket, error) {
+	return getSockets(t.getSortedPools(), func(pool *Pool) (*TaskSocket, error) {
+		return pool.GetPinnedContext(ctx, key)
+	})
+}
+
+// GetAvailablePinnedSocketsContext 从每个网关各获取一个key对应的有序通道的socket，获取失败的网关会被跳过，并通过*contract.PartialError返回
+func (t *Manger) GetAvailablePinnedSocketsContext(ctx context.Context, key string) ([]*TaskSocket, error) {
+	return getAvailableSockets(t.getSortedPools(), func(pool *Pool) (*TaskSocket, error) {
+		return pool.GetPinnedContext(ctx, key)
+	})
+}
+
+func getSockets(pools []*Pool, get func(pool *Pool) (*TaskSocket, error)) ([]*TaskSocket, error) {
+	ret := make([]*TaskSocket, 0, len(pools))
+	for _, pool := range pools {
+		socket, err := get(pool)
+		if err != nil {
+			//网关在获取期间被移除，跳过即可
+			if errors.Is(err, contract.ErrPoolClosed) {
+				continue
+			}
 			for _, s := range ret {
 				s.Release()
 			}
-			ret = nil
-			break
+			return nil, &contract.GatewayError{Addr: pool.GetAddr(), Err: err}
 		}
 		ret = append(ret, socket)
 	}
-	return ret
+	return ret, nil
+}
+
+func getAvailableSockets(pools []*Pool, get func(pool *Pool) (*TaskSocket, error)) ([]*TaskSocket, error) {
+	ret := make([]*TaskSocket, 0, len(pools))
+	var skipped []*contract.GatewayError
+	for _, pool := range pools {
+		socket, err := get(pool)
+		if err != nil {
+			if errors.Is(err, contract.ErrPoolClosed) {
+				continue
+			}
+			skipped = append(skipped, &contract.GatewayError{Addr: pool.GetAddr(), Err: err})
+			continue
+		}
+		ret = append(ret, socket)
+	}
+	if len(skipped) > 0 {
+		return ret, &contract.PartialError{Skipped: skipped}
+	}
+	return ret, nil
 }
 
 func (t *Manger) GetSocket(addrAsHex string) *TaskSocket {
+	socket, _ := t.GetSocketContext(context.Background(), addrAsHex)
+	return socket
+}
+
+// GetSocketContext 从指定网关的池中获取一个socket
+func (t *Manger) GetSocketContext(ctx context.Context, addrAsHex string) (*TaskSocket, error) {
+	t.mux.RLock()
 	pool, ok := t.pools[addrAsHex]
+	t.mux.RUnlock()
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("%w: %s", contract.ErrGatewayNotFound, addrAsHex)
 	}
-	return pool.Get()
+	socket, err := pool.GetContext(ctx)
+	if err != nil {
+		return nil, &contract.GatewayError{Addr: pool.GetAddr(), Err: err}
+	}
+	return socket, nil
+}
+
+// GetPinnedSocketContext 从指定网关获取key对应的有序通道的socket
+func (t *Manger) GetPinnedSocketContext(ctx context.Context, addrAsHex string, key string) (*TaskSocket, error) {
+	t.mux.RLock()
+	pool, ok := t.pools[addrAsHex]
+	t.mux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", contract.ErrGatewayNotFound, addrAsHex)
+	}
+	socket, err := pool.GetPinnedContext(ctx, key)
+	if err != nil {
+		return nil, &contract.GatewayError{Addr: pool.GetAddr(), Err: err}
+	}
+	return socket, nil
+}
+
+// GetAsyncWriter 获取指定网关的异步写入器，网关没有配置异步写入器时返回nil
+func (t *Manger) GetAsyncWriter(addrAsHex string) (*AsyncWriter, error) {
+	t.mux.RLock()
+	pool, ok := t.pools[addrAsHex]
+	t.mux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", contract.ErrGatewayNotFound, addrAsHex)
+	}
+	return pool.AsyncWriter(), nil
+}
+
+// GetAsyncWriters 获取所有网关的异步写入器，只要有一个网关没有配置异步写入器，就返回nil
+func (t *Manger) GetAsyncWriters() []*AsyncWriter {
+	pools := t.getPools()
+	ret := make([]*AsyncWriter, 0, len(pools))
+	for _, pool := range pools {
+		if pool.AsyncWriter() == nil {
+			return nil
+		}
+		ret = append(ret, pool.AsyncWriter())
+	}
+	return ret
+}
+
+// getPools 获取当前所有网关的池的快照，避免在持有锁的情况下等待socket
+func (t *Manger) getPools() []*Pool {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	ret := make([]*Pool, 0, len(t.pools))
+	for _, pool := range t.pools {
+		ret = append(ret, pool)
+	}
+	return ret
+}
+
+// getSortedPools 获取按地址排序的池的快照，同时持有多个有序通道时按相同的顺序获取，避免互相等待
+func (t *Manger) getSortedPools() []*Pool {
+	ret := t.getPools()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].GetAddr() < ret[j].GetAddr()
+	})
+	return ret
 }
@@ -17,7 +17,13 @@
 package taskSocket
 
 import (
+	"context"
+	"errors"
 	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
+	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -31,6 +37,7 @@ func TestTaskSocketPoolManger_NewManger(t *testing.T) {
 }
 
 func TestTaskSocketPoolManger_AddSocket_GetSocket(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	poolManger := NewManger()
 	factory := NewFactory("127.0.0.1:6062", time.Second*10, time.Second*10, time.Second*10)
 	pool := NewPool(10, factory, time.Second*10, time.Second*10, []byte("~6YOt5rW35piO~"))
@@ -49,6 +56,7 @@ func TestTaskSocketPoolManger_AddSocket_GetSocket(t *testing.T) {
 }
 
 func TestTaskSocketPoolManger_GetSockets(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	poolManger := NewManger()
 	factory := NewFactory("127.0.0.1:6062", time.Second*10, time.Second*10, time.Second*10)
 	pool := NewPool(10, factory, time.Second*10, time.Second*10, []byte("~6YOt5rW35piO~"))
@@ -83,3 +91,172 @@ func TestTaskSocketPoolManger_Close(t *testing.T) {
 		t.Error("Close failed")
 	}
 }
+
+func TestTaskSocketPoolManger_GetSocketContext_NotFound(t *testing.T) {
+	poolManger := NewManger()
+	defer poolManger.Close()
+	_, err := poolManger.GetSocketContext(context.Background(), contract.AddrConvertToHex("127.0.0.1:6062"))
+	if !errors.Is(err, contract.ErrGatewayNotFound) {
+		t.Error("GetSocketContext should return contract.ErrGatewayNotFound", err)
+	}
+}
+
+func TestTaskSocketPoolManger_GetSocketsContext_GatewayError(t *testing.T) {
+	addr := testHelper.DeadAddr(t)
+	poolManger := NewManger()
+	defer poolManger.Close()
+	factory := NewFactory(addr, time.Second*10, time.Second*10, time.Second*10)
+	poolManger.AddSocket(NewPool(1, factory, time.Millisecond*100, time.Second*10, []byte("~6YOt5rW35piO~")))
+	taskSockets, err := poolManger.GetSocketsContext(context.Background())
+	if taskSockets != nil {
+		t.Error("GetSocketsContext should return nil")
+	}
+	var gatewayErr *contract.GatewayError
+	if !errors.As(err, &gatewayErr) || gatewayErr.Addr != addr {
+		t.Error("GetSocketsContext should return contract.GatewayError", err)
+	}
+	if !errors.Is(err, contract.ErrGatewayDisconnected) {
+		t.Error("GetSocketsContext should wrap contract.ErrGatewayDisconnected", err)
+	}
+}
+
+func TestTaskSocketPoolManger_GetAvailableSocketsContext(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	deadAddr := testHelper.DeadAddr(t)
+	poolManger := NewManger()
+	defer poolManger.Close()
+	for _, addr := range []string{ln.Addr().String(), deadAddr} {
+		factory := NewFactory(addr, time.Second*10, time.Second*10, time.Second*10)
+		poolManger.AddSocket(NewPool(1, factory, time.Millisecond*100, time.Second*10, []byte("~6YOt5rW35piO~")))
+	}
+	taskSockets, err := poolManger.GetAvailableSocketsContext(context.Background())
+	defer func() {
+		for _, taskSocket := range taskSockets {
+			taskSocket.Release()
+		}
+	}()
+	if len(taskSockets) != 1 || taskSockets[0].GetAddr() != ln.Addr().String() {
+		t.Error("GetAvailableSocketsContext should return the healthy gateway")
+	}
+	var partialErr *contract.PartialError
+	if !errors.As(err, &partialErr) || len(partialErr.Addrs()) != 1 || partialErr.Addrs()[0] != deadAddr {
+		t.Error("GetAvailableSocketsContext should report the skipped gateway", err)
+	}
+	if !errors.Is(err, contract.ErrGatewayDisconnected) {
+		t.Error("GetAvailableSocketsContext should wrap contract.ErrGatewayDisconnected", err)
+	}
+}
+
+func TestTaskSocketPoolManger_AddGateway_RemoveGateway(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	poolManger := NewManger()
+	defer poolManger.Close()
+	factory := NewFactory(ln.Addr().String(), time.Second*10, time.Second*10, time.Second*10)
+	pool := NewPool(2, factory, time.Millisecond*100, time.Second*10, []byte("~6YOt5rW35piO~"))
+	if !poolManger.AddGateway(pool) || poolManger.AddGateway(pool) {
+		t.Fatal("AddGateway failed")
+	}
+	addrAsHex := contract.AddrConvertToHex(factory.GetAddr())
+	//并发的借用与归还，同时移除网关
+	wg := sync.WaitGroup{}
+	borrowed := make(chan *TaskSocket, 1)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				taskSocket, err := poolManger.GetSocketContext(context.Background(), addrAsHex)
+				if err != nil {
+					continue
+				}
+				select {
+				case borrowed <- taskSocket:
+				default:
+					taskSocket.Release()
+				}
+			}
+		}()
+	}
+	taskSocket := <-borrowed
+	if !poolManger.RemoveGateway(factory.GetAddr()) || poolManger.RemoveGateway(factory.GetAddr()) {
+		t.Error("RemoveGateway failed")
+	}
+	wg.Wait()
+	if poolManger.Count() != 0 {
+		t.Error("RemoveGateway failed")
+	}
+	//借出的socket在归还时关闭
+	taskSocket.Release()
+	for len(borrowed) > 0 {
+		(<-borrowed).Release()
+	}
+	if taskSocket.IsConnected() {
+		t.Error("borrowed socket should be closed when released to a removed gateway")
+	}
+	if len(pool.pool) != 0 || len(pool.size) != cap(pool.size) {
+		t.Error("RemoveGateway should drain the pool")
+	}
+	if _, err := pool.GetContext(context.Background()); !errors.Is(err, contract.ErrPoolClosed) {
+		t.Error("GetContext should return contract.ErrPoolClosed", err)
+	}
+}
+
+// fakeResolver 把主机名解析为固定的ip列表
+type fakeResolver map[string][]net.IPAddr
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := r[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestTaskSocketPoolManger_WithResolver(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	poolManger := NewManger(WithResolver(fakeResolver{"gateway.local": {{IP: net.ParseIP("127.0.0.1")}}}))
+	defer poolManger.Close()
+	addr := "gateway.local:" + port
+	factory := NewFactory(addr, time.Second, time.Second, time.Second, socket.WithDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, "tcp", ln.Addr().String())
+	}))
+	if !poolManger.AddGateway(NewPool(1, factory, time.Second, time.Second*10, []byte("~6YOt5rW35piO~"))) {
+		t.Fatal("AddGateway failed")
+	}
+	//uniqId中编码的是解析后的ip地址
+	addrAsHex := contract.AddrConvertToHex(ln.Addr().String())
+	if poolManger.AddrAsHex(addr) != addrAsHex {
+		t.Error("hostname should be resolved", poolManger.AddrAsHex(addr))
+	}
+	taskSocket, err := poolManger.GetSocketContext(context.Background(), addrAsHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskSocket.Release()
+	if !poolManger.RemoveGateway(addr) || poolManger.Count() != 0 {
+		t.Error("RemoveGateway should find the gateway by its hostname")
+	}
+}
+
+func TestTaskSocketPoolManger_CloseContext(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	manger := NewManger()
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	manger.AddSocket(NewPool(1, factory, 0, time.Hour, []byte("~6YOt5rW35piO~")))
+	borrowed, err := manger.GetSocketContext(context.Background(), manger.AddrAsHex(ln.Addr().String()))
+	if err != nil {
+		t.Fatal("GetSocketContext failed", err)
+	}
+	defer borrowed.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err = manger.CloseContext(ctx)
+	var gatewayErr *contract.GatewayError
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &gatewayErr) || gatewayErr.Addr != ln.Addr().String() {
+		t.Error("CloseContext should report the gateway that did not drain", err)
+	}
+	if manger.Count() != 0 {
+		t.Error("CloseContext should remove all gateways")
+	}
+}
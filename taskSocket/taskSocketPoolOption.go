@@ -0,0 +1,98 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"time"
+)
+
+// PoolOption Pool的可选配置
+type PoolOption func(t *Pool)
+
+// WithLanes 设置有序通道的数量，默认是1，参见Pool.GetPinnedContext
+// 每个有序通道独占一个连接，不占用池的容量
+func WithLanes(lanes int) PoolOption {
+	return func(t *Pool) {
+		t.lanes = make([]*lane, max(lanes, 1))
+	}
+}
+
+// WithAsyncWriter 为池创建一个异步写入器，参见Pool.AsyncWriter
+// 异步写入器独占一个连接，不占用池的容量
+func WithAsyncWriter(config AsyncWriterConfig) PoolOption {
+	return func(t *Pool) {
+		t.asyncWriterConfig = &config
+	}
+}
+
+// WithMinIdle 设置池中最少保持的空闲socket数量，LoopHeartbeat启动时立即预先建立连接，之后每次心跳时补足，不超过池的容量
+func WithMinIdle(minIdle int) PoolOption {
+	return func(t *Pool) {
+		t.minIdle = minIdle
+	}
+}
+
+// WithMaxIdleTime 设置socket的最大空闲时间，心跳时关闭空闲超时的socket，但是保留MinIdle个，小于等于0表示不限制
+// 心跳发送的数据不算作使用
+func WithMaxIdleTime(maxIdleTime time.Duration) PoolOption {
+	return func(t *Pool) {
+		t.maxIdleTime = maxIdleTime
+	}
+}
+
+// WithMaxLifetime 设置socket的最大存活时间，超过后在心跳时或者归还时关闭，小于等于0表示不限制
+// 网关重启或者扩容后，定期重建连接可以让连接重新均衡，该配置同样作用于有序通道的连接
+func WithMaxLifetime(maxLifetime time.Duration) PoolOption {
+	return func(t *Pool) {
+		t.maxLifetime = maxLifetime
+	}
+}
+
+// WithHealthCheck 开启健康检查，心跳时发送请求并等待网关的响应，替代只发送不接收的心跳，参见HealthCheckConfig
+// 连续失败达到阈值后池被标记为不健康，获取socket时立即返回contract.ErrGatewayUnhealthy，直到心跳时的检查成功
+func WithHealthCheck(config HealthCheckConfig) PoolOption {
+	return func(t *Pool) {
+		t.healthCheck = &config
+	}
+}
+
+// WithCircuitBreaker 开启熔断器，连接网关失败或者借出期间收发失败达到阈值后，获取socket时立即返回*contract.CircuitOpenError，参见BreakerConfig
+func WithCircuitBreaker(config BreakerConfig) PoolOption {
+	return func(t *Pool) {
+		t.breakerConfig = &config
+	}
+}
+
+// WithLeakDetection 开启泄漏检测，借出socket时记录调用栈，心跳时报告借出超过阈值仍未归还的socket，参见LeakDetectionConfig
+// 记录调用栈有一定的开销，建议只在调试时开启
+func WithLeakDetection(config LeakDetectionConfig) PoolOption {
+	return func(t *Pool) {
+		t.leakDetection = &config
+	}
+}
+
+// MangerOption Manger的可选配置
+type MangerOption func(t *Manger)
+
+// WithResolver 设置解析网关地址中的主机名的解析器，默认是net.DefaultResolver
+// 主机名只在添加网关时解析一次，解析结果是按uniqId路由到该网关的依据
+func WithResolver(resolver contract.Resolver) MangerOption {
+	return func(t *Manger) {
+		t.resolver = resolver
+	}
+}
@@ -18,6 +18,10 @@ package taskSocket
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
 	"github.com/buexplain/netsvr-business-go/v2/log"
 	"log/slog"
 	"strings"
@@ -54,6 +58,7 @@ func TestTaskSocketPool_GetAddr(t *testing.T) {
 }
 
 func TestTaskSocketPool_Get(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	size := 10
 	factory := NewFactory("127.0.0.1:6062", time.Second*10, time.Second*10, time.Second*10)
 	pool := NewPool(size, factory, time.Second*10, time.Second*10, []byte("~6YOt5rW35piO~"))
@@ -82,6 +87,7 @@ func TestTaskSocketPool_Get(t *testing.T) {
 }
 
 func TestTaskSocketPool_ConcurrencyGet(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	size := 10
 	factory := NewFactory("127.0.0.1:6062", time.Second*10, time.Second*10, time.Second*10)
 	pool := NewPool(size, factory, time.Second*10, time.Second*10, []byte("~6YOt5rW35piO~"))
@@ -110,6 +116,7 @@ func TestTaskSocketPool_ConcurrencyGet(t *testing.T) {
 }
 
 func TestTaskSocketPool_WaitTimeoutGet(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	size := 2
 	factory := NewFactory("127.0.0.1:6062", time.Second*10, time.Second*10, time.Second*10)
 	pool := NewPool(size, factory, time.Second*10, time.Second*10, []byte("~6YOt5rW35piO~"))
@@ -143,6 +150,7 @@ func TestTaskSocketPool_WaitTimeoutGet(t *testing.T) {
 }
 
 func TestTaskSocketPool_LoopHeartbeat(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	stdOut := bytes.NewBuffer(nil)
 	defaultLog := log.GetLogger()
 	log.SetLogger(slog.New(slog.NewTextHandler(stdOut, nil)))
@@ -171,6 +179,7 @@ func TestTaskSocketPool_LoopHeartbeat(t *testing.T) {
 }
 
 func TestTaskSocketPool_Close(t *testing.T) {
+	testHelper.RequireGateway(t, "127.0.0.1:6062")
 	size := 10
 	factory := NewFactory("127.0.0.1:6062", time.Second*10, time.Second*10, time.Second*10)
 	pool := NewPool(size, factory, time.Second*10, time.Second*10, []byte("~6YOt5rW35piO~"))
@@ -202,3 +211,233 @@ func TestTaskSocketPool_Close(t *testing.T) {
 		t.Error("Close failed")
 	}
 }
+
+func TestTaskSocketPool_GetContext(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second*10, time.Second*10, time.Second*10)
+	pool := NewPool(1, factory, 0, time.Second*10, []byte("~6YOt5rW35piO~"))
+	defer pool.Close()
+	taskSocket, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	defer taskSocket.Release()
+	//池已经耗尽，waitTimeout为0，只能依靠ctx结束等待
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	if _, err = pool.GetContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("GetContext should return context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("GetContext did not respect ctx deadline")
+	}
+	if len(pool.size) != 0 {
+		t.Error("GetContext failed")
+	}
+}
+
+func TestTaskSocketPool_GetContext_Exhausted(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second*10, time.Second*10, time.Second*10)
+	pool := NewPool(1, factory, time.Millisecond*100, time.Second*10, []byte("~6YOt5rW35piO~"))
+	defer pool.Close()
+	taskSocket, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	defer taskSocket.Release()
+	if _, err = pool.GetContext(context.Background()); !errors.Is(err, contract.ErrPoolExhausted) {
+		t.Error("GetContext should return contract.ErrPoolExhausted", err)
+	}
+}
+
+func TestTaskSocketPool_GetContext_Disconnected(t *testing.T) {
+	addr := testHelper.DeadAddr(t)
+	factory := NewFactory(addr, time.Second*10, time.Second*10, time.Second*10)
+	pool := NewPool(1, factory, time.Millisecond*100, time.Second*10, []byte("~6YOt5rW35piO~"))
+	defer pool.Close()
+	if _, err := pool.GetContext(context.Background()); !errors.Is(err, contract.ErrGatewayDisconnected) {
+		t.Error("GetContext should return contract.ErrGatewayDisconnected", err)
+	}
+	if len(pool.size) != 1 {
+		t.Error("GetContext failed")
+	}
+}
+
+// eventually 等待cond成立，超时则失败
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 3)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestTaskSocketPool_MinIdle(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(4, factory, time.Second, time.Hour, []byte("~6YOt5rW35piO~"), WithMinIdle(2))
+	defer pool.Close()
+	//启动时立即预先建立连接，不需要等待第一次心跳
+	pool.LoopHeartbeat()
+	eventually(t, func() bool {
+		return len(pool.pool) == 2
+	})
+	if len(pool.size) != 2 {
+		t.Error("warm up should take pool capacity", len(pool.size))
+	}
+}
+
+func TestTaskSocketPool_MaxIdleTime(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(4, factory, time.Second, time.Millisecond*20, []byte("~6YOt5rW35piO~"), WithMinIdle(1), WithMaxIdleTime(time.Millisecond*50))
+	defer pool.Close()
+	sockets := make([]*TaskSocket, 0, 3)
+	for i := 0; i < 3; i++ {
+		socket, err := pool.GetContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sockets = append(sockets, socket)
+	}
+	for _, socket := range sockets {
+		socket.Release()
+	}
+	pool.LoopHeartbeat()
+	//空闲超时的socket被关闭，只保留MinIdle个
+	eventually(t, func() bool {
+		return len(pool.pool) == 1 && len(pool.size) == 3
+	})
+	connected := 0
+	for _, socket := range sockets {
+		if socket.IsConnected() {
+			connected++
+		}
+	}
+	if connected != 1 {
+		t.Error("only the remaining idle socket should be connected", connected)
+	}
+}
+
+func TestTaskSocketPool_MaxLifetime(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(2, factory, time.Second, time.Millisecond*20, []byte("~6YOt5rW35piO~"), WithMaxLifetime(time.Millisecond*100))
+	defer pool.Close()
+	//归还时超过最大存活时间的socket被关闭
+	borrowed, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 150)
+	borrowed.Release()
+	if borrowed.IsConnected() || len(pool.pool) != 0 || len(pool.size) != 2 {
+		t.Error("expired socket should be closed on release")
+	}
+	//心跳时空闲的socket超过最大存活时间被关闭，MinIdle会补充新的连接
+	idle, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle.Release()
+	pinned, err := pool.GetPinnedContext(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned.Release()
+	pool.LoopHeartbeat()
+	eventually(t, func() bool {
+		return !idle.IsConnected() && !pinned.IsConnected()
+	})
+}
+
+func TestTaskSocketPool_MaxLifetime_MinIdle(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(1, factory, time.Second, time.Millisecond*20, []byte("~6YOt5rW35piO~"), WithMinIdle(1), WithMaxLifetime(time.Millisecond*100))
+	defer pool.Close()
+	pool.LoopHeartbeat()
+	eventually(t, func() bool {
+		return len(pool.pool) == 1
+	})
+	first, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Release()
+	//过期的连接被替换为新的连接
+	eventually(t, func() bool {
+		socket, err := pool.GetContext(context.Background())
+		if err != nil {
+			return false
+		}
+		defer socket.Release()
+		return socket != first && socket.IsConnected()
+	})
+}
+
+func TestTaskSocketPool_CloseContext(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(2, factory, 0, time.Hour, []byte("~6YOt5rW35piO~"), WithLanes(1))
+	borrowed, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	pinned, err := pool.GetPinnedContext(context.Background(), "key")
+	if err != nil {
+		t.Fatal("GetPinnedContext failed", err)
+	}
+	time.AfterFunc(time.Millisecond*50, func() {
+		borrowed.Release()
+		pinned.Release()
+	})
+	start := time.Now()
+	if err = pool.CloseContext(context.Background()); err != nil {
+		t.Fatal("CloseContext failed", err)
+	}
+	if time.Since(start) < time.Millisecond*40 {
+		t.Error("CloseContext should wait for borrowed sockets")
+	}
+	if borrowed.IsConnected() || pinned.IsConnected() || len(pool.pool) != 0 || len(pool.size) != 2 {
+		t.Error("returned sockets should be closed")
+	}
+	//waitTimeout为0，关闭后也不会阻塞
+	if _, err = pool.GetContext(context.Background()); !errors.Is(err, contract.ErrPoolClosed) {
+		t.Error("GetContext should return contract.ErrPoolClosed", err)
+	}
+	if _, err = pool.GetPinnedContext(context.Background(), "key"); !errors.Is(err, contract.ErrPoolClosed) {
+		t.Error("GetPinnedContext should return contract.ErrPoolClosed", err)
+	}
+}
+
+func TestTaskSocketPool_CloseContext_Deadline(t *testing.T) {
+	ln := testHelper.ListenSilent(t)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(2, factory, 0, time.Hour, []byte("~6YOt5rW35piO~"))
+	borrowed, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err = pool.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("CloseContext should return context.DeadlineExceeded", err)
+	}
+	if borrowed.IsConnected() {
+		t.Error("CloseContext should close borrowed sockets after ctx done")
+	}
+	borrowed.Release()
+	if len(pool.size) != 2 || len(pool.pool) != 0 {
+		t.Error("Release after CloseContext should return the capacity", len(pool.size), len(pool.pool))
+	}
+	//已经全部归还，再次关闭立即返回
+	if err = pool.CloseContext(context.Background()); err != nil {
+		t.Error("CloseContext failed", err)
+	}
+}
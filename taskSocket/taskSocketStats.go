@@ -0,0 +1,174 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets 往返耗时直方图的桶的上界，超过最后一个上界的耗时计入+Inf桶
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// PoolStats 池的统计快照
+type PoolStats struct {
+	//网关地址
+	Addr string
+	//累计建立的连接数
+	Created uint64
+	//当前借出的连接数，不含有序通道与异步写入器的连接
+	InUse int
+	//当前池中空闲的连接数
+	Idle int
+	//池中没有空闲连接，需要等待归还的次数
+	Waits uint64
+	//等待超过waitTimeout的次数
+	WaitTimeouts uint64
+	//心跳发送失败的次数
+	HeartbeatFailures uint64
+	//连接网关失败的次数
+	ConnectFailures uint64
+	//健康检查失败的次数，包括开启健康检查后连接网关失败的次数
+	HealthCheckFailures uint64
+	//池是否健康，参见WithHealthCheck
+	Healthy bool
+	//熔断器的状态与打开的次数，参见WithCircuitBreaker
+	Breaker      BreakerState
+	BreakerOpens uint64
+	//发送的字节数，包含长度头
+	BytesSent uint64
+	//接收的字节数，包含长度头
+	BytesReceived uint64
+	//请求往返耗时的直方图
+	Latency LatencyStats
+}
+
+// LatencyStats 请求往返耗时的直方图快照
+type LatencyStats struct {
+	//请求次数
+	Count uint64
+	//耗时总和
+	Sum time.Duration
+	//各个桶的计数，不累加，最后一个桶的上界为0，表示+Inf
+	Buckets []LatencyBucket
+}
+
+// LatencyBucket 直方图的一个桶
+type LatencyBucket struct {
+	//耗时小于等于UpperBound的请求计入该桶，为0时表示+Inf
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// Mean 平均耗时，没有请求时返回0
+func (s LatencyStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// poolStats 池的计数器
+type poolStats struct {
+	created             atomic.Uint64
+	waits               atomic.Uint64
+	waitTimeouts        atomic.Uint64
+	heartbeatFailures   atomic.Uint64
+	connectFailures     atomic.Uint64
+	healthCheckFailures atomic.Uint64
+	latency             latencyHistogram
+}
+
+// latencyHistogram 无锁的往返耗时直方图
+type latencyHistogram struct {
+	buckets [len(latencyBuckets) + 1]atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(d))
+	h.count.Add(1)
+}
+
+func (h *latencyHistogram) snapshot() LatencyStats {
+	ret := LatencyStats{
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()),
+		Buckets: make([]LatencyBucket, len(h.buckets)),
+	}
+	for i := range h.buckets {
+		if i < len(latencyBuckets) {
+			ret.Buckets[i].UpperBound = latencyBuckets[i]
+		}
+		ret.Buckets[i].Count = h.buckets[i].Load()
+	}
+	return ret
+}
+
+// Stats 池的统计快照，各项数据分别读取，彼此之间不保证严格一致
+func (t *Pool) Stats() PoolStats {
+	idle := len(t.pool)
+	ret := PoolStats{
+		Addr:                t.GetAddr(),
+		Created:             t.stats.created.Load(),
+		InUse:               max(cap(t.size)-len(t.size)-idle, 0),
+		Idle:                idle,
+		Waits:               t.stats.waits.Load(),
+		WaitTimeouts:        t.stats.waitTimeouts.Load(),
+		HeartbeatFailures:   t.stats.heartbeatFailures.Load(),
+		ConnectFailures:     t.stats.connectFailures.Load(),
+		HealthCheckFailures: t.stats.healthCheckFailures.Load(),
+		Healthy:             t.Healthy(),
+		Breaker:             t.BreakerState(),
+		BytesSent:           t.factory.TrafficCounter().Sent(),
+		BytesReceived:       t.factory.TrafficCounter().Received(),
+		Latency:             t.stats.latency.snapshot(),
+	}
+	if t.breaker != nil {
+		ret.BreakerOpens = t.breaker.opens.Load()
+	}
+	return ret
+}
+
+// Stats 所有网关的池的统计快照，key是网关地址
+func (t *Manger) Stats() map[string]PoolStats {
+	pools := t.getPools()
+	ret := make(map[string]PoolStats, len(pools))
+	for _, pool := range pools {
+		ret[pool.GetAddr()] = pool.Stats()
+	}
+	return ret
+}
@@ -0,0 +1,127 @@
+/**
+* Copyright 2024 buexplain@qq.com
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+* http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package taskSocket
+
+import (
+	"context"
+	"errors"
+	"github.com/buexplain/netsvr-business-go/v2/contract"
+	"github.com/buexplain/netsvr-business-go/v2/internal/testHelper"
+	"github.com/buexplain/netsvr-business-go/v2/socket"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := latencyHistogram{}
+	h.observe(time.Microsecond)
+	h.observe(time.Millisecond)
+	h.observe(time.Millisecond * 3)
+	h.observe(time.Minute)
+	s := h.snapshot()
+	if s.Count != 4 || s.Sum != time.Microsecond+time.Millisecond*4+time.Minute {
+		t.Fatal("latency count or sum mismatch", s.Count, s.Sum)
+	}
+	if len(s.Buckets) != len(latencyBuckets)+1 {
+		t.Fatal("latency buckets mismatch", len(s.Buckets))
+	}
+	if s.Buckets[0].UpperBound != time.Millisecond || s.Buckets[0].Count != 2 {
+		t.Error("1ms bucket mismatch", s.Buckets[0])
+	}
+	if s.Buckets[2].UpperBound != time.Millisecond*5 || s.Buckets[2].Count != 1 {
+		t.Error("5ms bucket mismatch", s.Buckets[2])
+	}
+	if last := s.Buckets[len(s.Buckets)-1]; last.UpperBound != 0 || last.Count != 1 {
+		t.Error("+Inf bucket mismatch", last)
+	}
+	if (LatencyStats{}).Mean() != 0 {
+		t.Error("mean of empty histogram should be 0")
+	}
+}
+
+func TestTaskSocketPool_Stats(t *testing.T) {
+	ln := testHelper.Listen(t, testHelper.Echo)
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	pool := NewPool(1, factory, time.Millisecond*50, time.Hour, []byte("~6YOt5rW35piO~"))
+	defer pool.Close()
+	taskSocket, err := pool.GetContext(context.Background())
+	if err != nil {
+		t.Fatal("GetContext failed", err)
+	}
+	req := socket.AcquireFrame()
+	defer req.Release()
+	req.Append([]byte("ping"))
+	resp := socket.AcquireFrame()
+	defer resp.Release()
+	if err = taskSocket.RoundTripContext(context.Background(), req, resp); err != nil {
+		t.Fatal("RoundTripContext failed", err)
+	}
+	if string(resp.Payload()) != "ping" {
+		t.Fatal("RoundTripContext response mismatch", string(resp.Payload()))
+	}
+	//池已经耗尽，等待超时
+	if _, err = pool.GetContext(context.Background()); !errors.Is(err, contract.ErrPoolExhausted) {
+		t.Fatal("GetContext should return contract.ErrPoolExhausted", err)
+	}
+	stats := pool.Stats()
+	if stats.Addr != ln.Addr().String() || stats.Created != 1 || stats.InUse != 1 || stats.Idle != 0 {
+		t.Error("stats of sockets mismatch", stats)
+	}
+	if stats.Waits != 1 || stats.WaitTimeouts != 1 {
+		t.Error("stats of waits mismatch", stats.Waits, stats.WaitTimeouts)
+	}
+	if stats.BytesSent != 8 || stats.BytesReceived != 8 {
+		t.Error("stats of bytes mismatch", stats.BytesSent, stats.BytesReceived)
+	}
+	if stats.Latency.Count != 1 || stats.Latency.Mean() <= 0 {
+		t.Error("stats of latency mismatch", stats.Latency)
+	}
+	taskSocket.Release()
+	stats = pool.Stats()
+	if stats.InUse != 0 || stats.Idle != 1 {
+		t.Error("stats after release mismatch", stats.InUse, stats.Idle)
+	}
+}
+
+func TestTaskSocketPool_Stats_ConnectFailures(t *testing.T) {
+	addr := testHelper.DeadAddr(t)
+	factory := NewFactory(addr, time.Second, time.Second, time.Second)
+	pool := NewPool(1, factory, time.Millisecond*50, time.Hour, []byte("~6YOt5rW35piO~"))
+	defer pool.Close()
+	if _, err := pool.GetContext(context.Background()); err == nil {
+		t.Fatal("GetContext should fail")
+	}
+	if _, err := pool.GetPinnedContext(context.Background(), "key"); err == nil {
+		t.Fatal("GetPinnedContext should fail")
+	}
+	stats := pool.Stats()
+	if stats.ConnectFailures != 2 || stats.Created != 0 || stats.InUse != 0 {
+		t.Error("stats of connect failures mismatch", stats)
+	}
+}
+
+func TestTaskSocketPoolManger_Stats(t *testing.T) {
+	ln := testHelper.Listen(t, testHelper.Echo)
+	manger := NewManger()
+	defer manger.Close()
+	factory := NewFactory(ln.Addr().String(), time.Second, time.Second, time.Second)
+	manger.AddSocket(NewPool(1, factory, time.Millisecond*50, time.Hour, []byte("~6YOt5rW35piO~")))
+	stats := manger.Stats()
+	if len(stats) != 1 || stats[ln.Addr().String()].Addr != ln.Addr().String() {
+		t.Error("Manger.Stats mismatch", stats)
+	}
+}